@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"soul-mirror/controller"
+	"strings"
+)
+
+// mirrorHandler 处理 /mirrors/ 下的请求
+//
+//	/mirrors/{name}/diff
+//	/mirrors/{name}/dryrun
+//	/mirrors/{name}/objects/{ns}/{name}/diff
+//	/mirrors/{name}/objects/{name}/diff  集群级别的资源
+func mirrorHandler(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, "/mirrors/"), "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "diff":
+		diffs, ok := filter.MirrorDiff(parts[0])
+		if !ok {
+			http.Error(writer, "mirror not found", http.StatusNotFound)
+			return
+		}
+		writeDiff(writer, request, diffs)
+	case len(parts) == 2 && parts[1] == "dryrun":
+		records, ok := filter.DryRuns(parts[0])
+		if !ok {
+			http.Error(writer, "mirror not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(writer, records)
+	case len(parts) == 4 && parts[1] == "objects" && parts[3] == "diff":
+		diffs, ok := filter.ObjectDiffs(parts[0], "", parts[2])
+		if !ok {
+			http.Error(writer, "object not found", http.StatusNotFound)
+			return
+		}
+		writeDiff(writer, request, diffs)
+	case len(parts) == 5 && parts[1] == "objects" && parts[4] == "diff":
+		diffs, ok := filter.ObjectDiffs(parts[0], parts[2], parts[3])
+		if !ok {
+			http.Error(writer, "object not found", http.StatusNotFound)
+			return
+		}
+		writeDiff(writer, request, diffs)
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+// deadLetterHandler 处理死信
+//
+//	GET    /deadletter
+//	POST   /deadletter/{id}/retry
+//	DELETE /deadletter/{id}
+func deadLetterHandler(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, "/deadletter"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "" && request.Method == http.MethodGet:
+		writeJSON(writer, filter.DeadLetters())
+	case len(parts) == 2 && parts[1] == "retry" && request.Method == http.MethodPost:
+		if !filter.RetryDeadLetter(parts[0]) {
+			http.Error(writer, "dead letter not found", http.StatusNotFound)
+		}
+	case len(parts) == 1 && parts[0] != "" && request.Method == http.MethodDelete:
+		if !filter.DiscardDeadLetter(parts[0]) {
+			http.Error(writer, "dead letter not found", http.StatusNotFound)
+		}
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+func mirrorsHandler(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, filter.Mirrors())
+}
+
+func clustersHandler(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, filter.Clusters())
+}
+
+// writeDiff 默认返回json格式的差异，format=unified 时返回统一diff格式
+func writeDiff(writer http.ResponseWriter, request *http.Request, diffs []filter.ObjectDiff) {
+	if request.URL.Query().Get("format") != "unified" {
+		writeJSON(writer, diffs)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, d := range diffs {
+		_, _ = writer.Write([]byte(d.Unified()))
+	}
+}
+
+func writeJSON(writer http.ResponseWriter, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
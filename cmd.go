@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"soul-mirror/controller"
+	"soul-mirror/model"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const usage = `Usage: manager [flags] [command] [command flags]
+
+Commands:
+  run        持续同步，默认命令
+  validate   检查配置
+  diff       输出每个mirror将要对从集群做的修改
+  sync-once  全量同步一次后退出，有资源同步失败时返回非0
+  migrate    将一个集群中符合条件的资源复制到另一个集群
+
+Flags:
+`
+
+// validate 检查配置并尝试初始化集群客户端，返回退出码
+func validate(appCfg *model.Config) int {
+	errs := appCfg.Validate()
+	for _, c := range appCfg.Clusters {
+		if err := filter.UpdateCluster(&c); err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s: %v", c.Name, err))
+		}
+	}
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if appCfg.LoopDetection != model.LoopDetectionRefuse {
+		for _, cycle := range appCfg.Cycles() {
+			fmt.Printf("warning: mirrors form a cycle %s\n", cycle)
+		}
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("config is valid")
+	return 0
+}
+
+// diff 输出每个mirror中与从集群不一致的资源
+func diff(appCfg *model.Config, args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	format := flags.String("format", "unified", "unified, json")
+	mirror := flags.String("mirror", "", "只输出指定mirror的差异")
+	_ = flags.Parse(args)
+
+	initMirrors(appCfg)
+	if !waitForCacheSync() {
+		return 1
+	}
+	for _, m := range appCfg.Mirrors {
+		if len(*mirror) > 0 && m.Name != *mirror {
+			continue
+		}
+		diffs, _ := filter.MirrorDiff(m.Name)
+		if *format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			_ = encoder.Encode(map[string]interface{}{"mirror": m.Name, "diffs": diffs})
+			continue
+		}
+		for _, d := range diffs {
+			fmt.Print(d.Unified())
+		}
+	}
+	return 0
+}
+
+// syncOnce 全量同步一次所有mirror
+func syncOnce(appCfg *model.Config) int {
+	initMirrors(appCfg)
+	if !waitForCacheSync() {
+		return 1
+	}
+	failed := filter.SyncOnce(logProgress)
+	if failed > 0 {
+		logrus.Errorf("%d objects failed to sync", failed)
+		return 1
+	}
+	return 0
+}
+
+// migrate 将一个集群中符合条件的资源复制到另一个集群，
+// 可以复用已有mirror的资源类型、选择器和filter，也可以通过参数指定资源类型
+func migrate(appCfg *model.Config, args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "来源集群")
+	to := flags.String("to", "", "目标集群")
+	mirror := flags.String("mirror", "", "复用该mirror的资源类型、选择器和filter")
+	resources := flags.String("resources", "", "逗号分隔的资源类型，格式为 group/version/kind，核心资源的group为空，如 /v1/configmaps")
+	namespace := flags.String("namespace", "", "只复制该命名空间中的资源")
+	selector := flags.String("selector", "", "标签选择器，如 app=demo")
+	_ = flags.Parse(args)
+
+	if len(*from) == 0 || len(*to) == 0 {
+		fmt.Println("--from and --to are required")
+		return 2
+	}
+	var m model.Mirror
+	if len(*mirror) > 0 {
+		found := false
+		for _, candidate := range appCfg.Mirrors {
+			if candidate.Name == *mirror {
+				m, found = candidate, true
+			}
+		}
+		if !found {
+			fmt.Printf("mirror %s not found\n", *mirror)
+			return 2
+		}
+	}
+	for _, r := range strings.Split(*resources, ",") {
+		if len(r) == 0 {
+			continue
+		}
+		parts := strings.Split(r, "/")
+		if len(parts) != 3 {
+			fmt.Printf("invalid resource %s\n", r)
+			return 2
+		}
+		m.Resources = append(m.Resources, model.MirrorSyncTarget{Group: parts[0], Version: parts[1], Kind: parts[2]})
+	}
+	if len(m.Resources) == 0 {
+		fmt.Println("--mirror or --resources is required")
+		return 2
+	}
+	if len(*selector) > 0 {
+		labelSelector, err := metav1.ParseToLabelSelector(*selector)
+		if err != nil {
+			fmt.Printf("invalid selector: %v\n", err)
+			return 2
+		}
+		m.Selector = labelSelector
+	}
+	if len(*namespace) > 0 {
+		m.Config.Namespace = *namespace
+		m.Config.Namespaces = nil
+	}
+	m.Name = strings.TrimSuffix("migrate-"+m.Name, "-")
+	m.Config.Mode = ""
+	m.Config.Clusters = model.MirrorCluster{Main: *from, Follower: []string{*to}}
+	m.Config.SyncCreate = true
+	m.Config.SyncDelete = false
+	// 迁移不回写状态也不上报事件
+	m.Config.WriteStatus = false
+	m.Config.DisableEvents = true
+	m.Config.FollowerEvents = false
+
+	appCfg.Mirrors = []model.Mirror{m}
+	if errs := appCfg.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		return 2
+	}
+	return syncOnce(appCfg)
+}
+
+func waitForCacheSync() bool {
+	stop := make(chan struct{})
+	if !filter.WaitForCacheSync(stop) {
+		logrus.Error("failed to wait for caches to sync")
+		return false
+	}
+	return true
+}
+
+func logProgress(mirror string, done, total int) {
+	if done == total || done%100 == 0 {
+		logrus.Infof("%s: %d/%d", mirror, done, total)
+	}
+}
@@ -1,67 +1,138 @@
 package filter
 
 import (
+	"context"
 	"soul-mirror/model"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/dynamic/dynamiclister"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/client-go/util/workqueue"
 )
 
 var (
 	mutex      = sync.Mutex{}
 	clusterMap = make(map[string]*cluster)
+	// Start 之后不为空，新增的mirror会立即启动
+	runStop <-chan struct{}
+	// 停止所有informer和mirror，由 Shutdown 调用
+	runCancel context.CancelFunc
 )
 
 type cluster struct {
 	name    string
 	mirrors map[string]*mirrorController
-	cache   map[string]dynamiclister.Lister
+	// 以该集群为主集群的mirror配置，包括分片到其他副本的mirror
+	desired map[string]model.Mirror
+	// 资源类型是否属于命名空间
+	scopes map[schema.GroupVersionResource]bool
 
-	config  *rest.Config
-	client  dynamic.Interface
-	factory dynamicinformer.DynamicSharedInformerFactory
-	// 用于在正式启动服务前拉取缓存
-	cacheFactory dynamicinformer.DynamicSharedInformerFactory
+	config *rest.Config
+	client dynamic.Interface
+	// informer使用的client，不设置超时，避免watch每隔超时时间被断开
+	watchClient dynamic.Interface
+	// 主集群资源的informer
+	informers *informerManager
+	// 从集群资源的缓存，在正式启动服务前拉取
+	caches *informerManager
+	// soul-mirror写入的资源版本，用于抑制回声和环路
+	written sync.Map
+
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	// 所有mirror写入该集群的速率限制
+	writeLimiter flowcontrol.RateLimiter
+	// 轮询模式下list的间隔，为0时使用watch
+	pollInterval time.Duration
+
+	health *clusterHealth
 }
 
 type mirrorController struct {
-	config model.Mirror
-	gvr    schema.GroupVersionResource
-	client dynamic.Interface
-	logger *logrus.Logger
+	config   model.Mirror
+	gvr      schema.GroupVersionResource
+	client   dynamic.Interface
+	logger   *logrus.Logger
+	selector labels.Selector
+	// 集群级别的资源不按命名空间过滤
+	namespaced bool
+	// 由定期全量比对放入队列的key，key为 从集群/资源，实际写入从集群后计入修复数
+	repairing sync.Map
+	// 试运行时每个从集群中资源的最近一次变化
+	dryRuns sync.Map
+	// 每个从集群最近一次同步的结果
+	followers sync.Map
+	// 资源是否为开启了status子资源的CRD
+	statusOnce sync.Once
+	hasStatus  bool
+	// 同步被工作负载引用的资源的隐式mirror，key为资源类型
+	references map[string]*mirrorController
+	// 隐式mirror只同步被引用的资源
+	refs *referenceSet
+	// 工作负载引用的资源，key为工作负载，用于移除不再被引用的资源
+	referenced sync.Map
 
-	indexer  cache.Indexer
-	informer cache.SharedIndexInformer
-	queue    workqueue.RateLimitingInterface
+	indexer   objectStore
+	informers []*sharedInformer
+	queue     workqueue.RateLimitingInterface
+	// 每个从集群独立的队列和重试状态
+	followerQueues map[string]workqueue.RateLimitingInterface
+	// 创建时的从集群，关闭时不再访问 clusterMap
+	followerClusters []*cluster
+	// 超过最大重试次数的资源，key为 从集群/资源
+	deadLetters sync.Map
+
+	// 每个从集群的缓存是否完成同步
+	followerSynced map[string][]cache.InformerSynced
+	// 每个从集群中资源的缓存，创建时确定，不随其他mirror的增删变化
+	listers map[string]dynamiclister.Lister
+	// 删除mirror时移除handler、释放informer并注销指标
+	cleanup   []func()
+	stop      chan struct{}
+	closeOnce sync.Once
+	// 所有API请求使用的context，退出时超过等待时间后取消
+	ctx    context.Context
+	cancel context.CancelFunc
+	// 正在同步的key数量
+	inflight int32
 }
 
-func Start(stop chan struct{}) {
-	// 缓存
-	for _, c := range clusterMap {
-		go c.cacheFactory.Start(stop)
-	}
+// Start 启动所有informer和mirror。每个mirror只等待自己的informer，每个从集群的worker只等待该从集群的缓存，
+// 一个资源类型不可用或没有权限时不影响其他mirror。ctx 结束后停止informer，首次同步期间也可以退出
+func Start(ctx context.Context) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	stop := ctx.Done()
+	// 健康检查
 	for _, c := range clusterMap {
-		c.cacheFactory.WaitForCacheSync(stop)
+		c := c
+		go wait.Until(func() { _, _ = c.probe() }, probeInterval, stop)
+		go wait.Until(c.pruneWritten, writtenTTL, stop)
 	}
 
 	// 启动
 	for _, c := range clusterMap {
+		c.caches.Start(stop)
+		c.informers.Start(stop)
 		for _, m := range c.mirrors {
-			//go m.informer.Run(stop)
-			go m.Run(8, stop)
+			go m.Run(m.workers(), stop)
 		}
 	}
+	runStop, runCancel = stop, cancel
 }
 
 func initCluster(obj *model.Cluster) (err error) {
@@ -72,8 +143,12 @@ func initCluster(obj *model.Cluster) (err error) {
 	c := &cluster{
 		name:    obj.Name,
 		mirrors: make(map[string]*mirrorController),
-		cache:   make(map[string]dynamiclister.Lister),
+		desired: make(map[string]model.Mirror),
+		scopes:  make(map[schema.GroupVersionResource]bool),
+		health:  newClusterHealth(),
 	}
+	c.informers = newInformerManager(c, 0)
+	c.caches = newInformerManager(c, 0)
 	err = c.setClient(obj)
 	if err != nil {
 		return err
@@ -82,76 +157,246 @@ func initCluster(obj *model.Cluster) (err error) {
 	return
 }
 
-func UpdateCluster(obj *model.Cluster) (err error) {
+// UpdateCluster 新增集群或更新集群的凭证和限速。informer在创建时绑定client，
+// 更新已有集群时先删除所有使用该集群的mirror，共享的informer全部释放后再用新的client重建
+func UpdateCluster(obj *model.Cluster) error {
 	mutex.Lock()
 	defer mutex.Unlock()
 	c, ok := clusterMap[obj.Name]
 	if !ok {
-		err = initCluster(obj)
-		if err != nil {
-			return
-		}
-		c, _ = clusterMap[obj.Name]
+		return initCluster(obj)
 	}
 
-	err = c.setClient(obj)
-	if err != nil {
-		return err
+	affected := make(map[*cluster][]model.Mirror)
+	for _, cl := range clusterMap {
+		for _, m := range cl.desired {
+			if cl == c || follows(m, c.name) {
+				affected[cl] = append(affected[cl], m)
+				cl.deleteMirror(m)
+			}
+		}
+	}
+	err := c.setClient(obj)
+	for cl, mirrors := range affected {
+		for _, m := range mirrors {
+			cl.updateMirror(m)
+		}
 	}
+	return err
+}
 
-	for _, mirror := range c.mirrors {
-		c.updateMirror(mirror.config)
+// follows 判断mirror是否同步到该集群
+func follows(obj model.Mirror, cluster string) bool {
+	for _, follower := range obj.Config.Clusters.Follower {
+		if follower == cluster {
+			return true
+		}
 	}
-	return
+	return false
 }
 
-func (c *cluster) setClient(obj *model.Cluster) (err error) {
+// RESTConfig 根据集群配置生成访问凭证，优先使用文本内容
+func RESTConfig(obj *model.Cluster) (*rest.Config, error) {
 	if len(obj.Config) > 0 {
-		c.config, err = clientcmd.RESTConfigFromKubeConfig([]byte(obj.Config))
-	} else {
-		c.config, err = clientcmd.BuildConfigFromFlags("", obj.ConfigPath)
+		return clientcmd.RESTConfigFromKubeConfig([]byte(obj.Config))
 	}
+	return clientcmd.BuildConfigFromFlags("", obj.ConfigPath)
+}
+
+// setClient 根据集群配置创建client，创建失败时保留原来的client
+func (c *cluster) setClient(obj *model.Cluster) error {
+	config, err := RESTConfig(obj)
 	if err != nil {
-		return
+		return err
 	}
-
-	c.client, err = dynamic.NewForConfig(c.config)
+	if obj.QPS > 0 {
+		config.QPS = obj.QPS
+	}
+	if obj.Burst > 0 {
+		config.Burst = obj.Burst
+	}
+	if obj.Timeout.Duration > 0 {
+		config.Timeout = obj.Timeout.Duration
+	}
+	client, err := dynamic.NewForConfig(config)
 	if err != nil {
-		return
+		return err
 	}
-	c.factory = dynamicinformer.NewDynamicSharedInformerFactory(c.client, 10*time.Minute)
-	c.cacheFactory = dynamicinformer.NewDynamicSharedInformerFactory(c.client, 0)
-	return
+	watchConfig := rest.CopyConfig(config)
+	watchConfig.Timeout = 0
+	watchClient, err := dynamic.NewForConfig(watchConfig)
+	if err != nil {
+		return err
+	}
+	c.config, c.client, c.watchClient = config, client, watchClient
+
+	c.writeLimiter = nil
+	c.pollInterval = 0
+	if obj.Mode == model.ClusterModePoll {
+		c.pollInterval = 30 * time.Second
+		if obj.PollInterval.Duration > 0 {
+			c.pollInterval = obj.PollInterval.Duration
+		}
+	}
+	if obj.WriteQPS > 0 {
+		burst := obj.WriteBurst
+		if burst <= 0 {
+			burst = 1
+		}
+		c.writeLimiter = flowcontrol.NewTokenBucketRateLimiter(obj.WriteQPS, burst)
+	}
+	return c.setRecorder()
 }
 
 func (c *cluster) initMirror(obj model.Mirror) {
+	c.buildMirror(obj, false)
+}
+
+// buildMirror 创建mirror并注册handler。references 为true时创建只同步被引用资源的隐式mirror，
+// 引用集合在注册handler之前设置，补发的Add事件不会同步其他资源
+func (c *cluster) buildMirror(obj model.Mirror, references bool) {
+	selector, err := metav1.LabelSelectorAsSelector(obj.Selector)
+	if err != nil || obj.Selector == nil {
+		selector = labels.Everything()
+	}
+	var referenceMirrors map[string]*mirrorController
 	for _, m := range obj.Resources {
 		gvr := schema.GroupVersionResource{Group: m.Group, Version: m.Version, Resource: m.Kind}
+		if obj.Config.IncludeReferences && isWorkload(gvr) && referenceMirrors == nil {
+			referenceMirrors = c.initReferences(obj)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
 		mirror := &mirrorController{
-			config:   obj,
-			gvr:      gvr,
-			client:   c.client,
-			informer: c.factory.ForResource(gvr).Informer(),
-			indexer:  c.factory.ForResource(gvr).Informer().GetIndexer(),
-			queue:    workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
-			logger:   logrus.WithField("Name", obj.Name).WithField("Main", obj.Name).Logger,
-		}
-		mirror.informer.AddEventHandler(mirror.genHandler())
+			config:         obj,
+			gvr:            gvr,
+			client:         c.client,
+			selector:       selector,
+			references:     referenceMirrors,
+			queue:          workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+			followerQueues: make(map[string]workqueue.RateLimitingInterface),
+			followerSynced: make(map[string][]cache.InformerSynced),
+			listers:        make(map[string]dynamiclister.Lister),
+			logger:         logrus.WithField("Name", obj.Name).WithField("Main", obj.Name).Logger,
+			stop:           make(chan struct{}),
+			ctx:            ctx,
+			cancel:         cancel,
+		}
+		if references {
+			mirror.refs = newReferenceSet()
+		}
+		mirror.namespaced = c.namespaced(gvr)
+		// 只list/watch符合条件的资源。限定了命名空间时每个命名空间启动一个informer，凭证只需要这些命名空间的权限
+		mirrorNamespaces := namespaces(obj.Config)
+		if len(mirrorNamespaces) == 0 || !mirror.namespaced {
+			mirrorNamespaces = []string{""}
+		}
+		store := make(namespacedStore)
+		for _, ns := range mirrorNamespaces {
+			key := informerKey{
+				gvr:           gvr,
+				namespace:     ns,
+				labelSelector: selector.String(),
+				fieldSelector: fieldSelector(obj.Config, mirror.namespaced),
+			}
+			informer := c.informers.acquire(key)
+			store[ns] = informer.GetIndexer()
+			mirror.informers = append(mirror.informers, informer)
+			mirror.cleanup = append(mirror.cleanup, informer.addHandler(mirror.genHandler()), func() {
+				c.informers.release(key)
+			})
+		}
+		mirror.indexer = store
+		if len(store) == 1 {
+			mirror.indexer = store[mirrorNamespaces[0]]
+		}
 		c.mirrors[mirror.String()] = mirror
+
+		cacheNamespaces := mirrorNamespaces
+		if renamed(obj) {
+			// 写入从集群时会修改命名空间或名字
+			cacheNamespaces = []string{""}
+		}
 		for _, cluster := range obj.Config.Clusters.Follower {
+			queue := workqueue.NewRateLimitingQueue(rateLimiter(obj.Config.Backoff))
+			mirror.followerQueues[cluster] = queue
+			mirror.gauge("follower_queue_length", prometheus.Labels{
+				"name":     mirror.config.Name,
+				"cluster":  c.name,
+				"resource": gvr.Resource,
+				"follower": cluster,
+			}, func() float64 {
+				return float64(queue.Len())
+			})
 			targetCluster := clusterMap[cluster]
-			targetCluster.cache[mirror.String()] = dynamiclister.New(targetCluster.cacheFactory.ForResource(gvr).Informer().GetIndexer(), gvr)
+			mirror.followerClusters = append(mirror.followerClusters, targetCluster)
+			indexers := make(map[string]cache.Indexer)
+			for _, ns := range cacheNamespaces {
+				cacheKey := informerKey{
+					gvr:          gvr,
+					namespace:    ns,
+					metadataOnly: obj.Config.MetadataOnlyCache,
+				}
+				if !renamed(obj) {
+					cacheKey.fieldSelector = fieldSelector(obj.Config, mirror.namespaced)
+				}
+				targetCache := targetCluster.caches.acquire(cacheKey)
+				indexers[ns] = targetCache.GetIndexer()
+				mirror.followerSynced[cluster] = append(mirror.followerSynced[cluster], targetCache.HasSynced)
+				mirror.cleanup = append(mirror.cleanup, func() {
+					targetCluster.caches.release(cacheKey)
+				})
+				if isNamespaceMirror(mirror) || isCRDMirror(mirror) {
+					mirror.cleanup = append(mirror.cleanup, targetCache.addHandler(dependencyHandler(targetCluster.name)))
+				}
+			}
+			mirror.listers[cluster] = newNamespacedLister(gvr, indexers)
 		}
 
-		promauto.NewGaugeFunc(prometheus.GaugeOpts{
-			Name: "event_queue_length",
-			ConstLabels: prometheus.Labels{
-				"name": mirror.config.Name,
-			},
+		mirror.gauge("event_queue_length", prometheus.Labels{
+			"name":     mirror.config.Name,
+			"cluster":  c.name,
+			"resource": gvr.Resource,
 		}, func() float64 {
 			return float64(mirror.queue.Len())
 		})
+		// 运行中新增的mirror
+		if runStop != nil {
+			go mirror.Run(mirror.workers(), runStop)
+		}
+	}
+	updateDependencies()
+}
+
+// gauge 注册mirror的指标，mirror被删除时注销
+func (m *mirrorController) gauge(name string, labels prometheus.Labels, f func() float64) {
+	g := prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, ConstLabels: labels}, f)
+	if err := prometheus.Register(g); err != nil {
+		m.logger.WithError(err).Warnf("failed to register metric %s", name)
+		return
 	}
+	m.cleanup = append(m.cleanup, func() {
+		prometheus.Unregister(g)
+	})
+}
+
+// hasSynced 主集群的informer是否都完成了首次同步
+func (m *mirrorController) hasSynced() bool {
+	for _, informer := range m.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// followerReady 从集群的缓存是否完成首次同步
+func (m *mirrorController) followerReady(follower string) bool {
+	for _, synced := range m.followerSynced[follower] {
+		if !synced() {
+			return false
+		}
+	}
+	return true
 }
 
 func (m *mirrorController) String() string {
@@ -161,35 +406,139 @@ func (m *mirrorController) String() string {
 func UpdateMirror(obj model.Mirror) {
 	mutex.Lock()
 	defer mutex.Unlock()
-	c := clusterMap[obj.Config.Clusters.Main]
+	if obj.Config.Mode == model.MirrorModeBidirectional {
+		// 每个对等集群都作为主集群，将修改同步到其他对等集群
+		for _, peer := range obj.Config.Clusters.Peers {
+			c, ok := clusterMap[peer]
+			if !ok {
+				logrus.Warnf("unknown peer cluster %s in mirror %s", peer, obj.Name)
+				continue
+			}
+			c.updateMirror(peerMirror(obj, peer))
+		}
+		return
+	}
+	c, ok := clusterMap[obj.Config.Clusters.Main]
+	if !ok {
+		logrus.Warnf("unknown main cluster %s in mirror %s", obj.Config.Clusters.Main, obj.Name)
+		return
+	}
 	c.updateMirror(obj)
 }
 
+func peerMirror(obj model.Mirror, main string) model.Mirror {
+	obj.Config.Clusters.Main = main
+	obj.Config.Clusters.Follower = nil
+	for _, peer := range obj.Config.Clusters.Peers {
+		if peer != main {
+			obj.Config.Clusters.Follower = append(obj.Config.Clusters.Follower, peer)
+		}
+	}
+	return obj
+}
+
 func (c *cluster) updateMirror(obj model.Mirror) {
+	c.desired[obj.Name] = obj
 	c.deleteMirror(obj)
-	c.initMirror(obj)
+	if owns(unit(obj)) {
+		c.initMirror(obj)
+	}
 }
 
 func (c *cluster) DeleteMirror(obj model.Mirror) {
 	mutex.Lock()
 	defer mutex.Unlock()
+	delete(c.desired, obj.Name)
 	c.deleteMirror(obj)
 }
 
 func (c *cluster) deleteMirror(obj model.Mirror) {
+	if obj.Config.IncludeReferences {
+		c.deleteMirror(referenceMirror(obj))
+	}
 	for _, m := range obj.Resources {
 		gvr := schema.GroupVersionResource{Group: m.Group, Version: m.Version, Resource: m.Kind}
 		mirror, ok := c.mirrors[obj.Name+gvr.String()]
 		if ok {
 			mirror.close()
 			delete(c.mirrors, mirror.String())
-			for _, cluster := range obj.Config.Clusters.Follower {
-				delete(clusterMap[cluster].cache, mirror.String())
-			}
 		}
 	}
+	updateDependencies()
+}
+
+func (m *mirrorController) workers() int {
+	if m.config.Config.Workers > 0 {
+		return m.config.Config.Workers
+	}
+	return 8
+}
+
+// rateLimiter 与 workqueue.DefaultControllerRateLimiter 相同，但可以设置退避的上下限
+func rateLimiter(backoff model.MirrorBackoff) workqueue.RateLimiter {
+	base, max := 5*time.Millisecond, 1000*time.Second
+	if backoff.Base.Duration > 0 {
+		base = backoff.Base.Duration
+	}
+	if backoff.Max.Duration > 0 {
+		max = backoff.Max.Duration
+	}
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(base, max),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+}
+
+// throttle 等待从集群的写入预算
+func (c *cluster) throttle() {
+	if c.writeLimiter != nil {
+		c.writeLimiter.Accept()
+	}
 }
 
 func (m *mirrorController) close() {
-	m.queue.ShutDown()
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		m.queue.ShutDown()
+		for _, queue := range m.followerQueues {
+			queue.ShutDown()
+		}
+		for _, f := range m.cleanup {
+			f()
+		}
+		m.forget()
+		// 正在同步的key完成后释放context
+		go func() {
+			_ = wait.PollImmediateInfinite(100*time.Millisecond, func() (bool, error) {
+				return m.idle(), nil
+			})
+			m.cancel()
+		}()
+	})
+}
+
+// forget 移除已删除的mirror中等待依赖、等待集群恢复的资源和死信
+func (m *mirrorController) forget() {
+	heldMutex.Lock()
+	for id, waiting := range held {
+		delete(waiting, m)
+		if len(waiting) == 0 {
+			delete(held, id)
+		}
+	}
+	heldMutex.Unlock()
+
+	for _, c := range m.followerClusters {
+		c.health.mutex.Lock()
+		if keys, ok := c.health.parked[m]; ok {
+			ParkedObjectCount.WithLabelValues(c.name).Sub(float64(len(keys)))
+			delete(c.health.parked, m)
+		}
+		c.health.mutex.Unlock()
+	}
+
+	m.deadLetters.Range(func(key, v interface{}) bool {
+		m.forgetDeadLetter(v.(*DeadLetter).Follower, v.(*DeadLetter).Key)
+		return true
+	})
 }
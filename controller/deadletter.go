@@ -0,0 +1,134 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// DeadLetter 重试次数超过 maxRetries 后不再同步的资源
+type DeadLetter struct {
+	ID       string `json:"id"`
+	Mirror   string `json:"mirror"`
+	Main     string `json:"main"`
+	Resource string `json:"resource"`
+	Follower string `json:"follower"`
+	Key      string `json:"key"`
+	// 移入死信时主集群中资源的版本，资源不存在时为空
+	ResourceVersion string    `json:"resourceVersion,omitempty"`
+	Error           string    `json:"error"`
+	Attempts        int       `json:"attempts"`
+	Time            time.Time `json:"time"`
+}
+
+func deadLetterID(m *mirrorController, follower, key string) string {
+	sum := sha256.Sum256([]byte(m.config.Config.Clusters.Main + "/" + m.String() + "/" + follower + "/" + key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// deadLetter 将资源移入死信，直到资源再次变化或被手动重试
+func (m *mirrorController) deadLetter(follower, key string, attempts int, err error) {
+	entry := &DeadLetter{
+		ID:              deadLetterID(m, follower, key),
+		Mirror:          m.config.Name,
+		Main:            m.config.Config.Clusters.Main,
+		Resource:        m.gvr.String(),
+		Follower:        follower,
+		Key:             key,
+		ResourceVersion: m.sourceVersion(key),
+		Error:           err.Error(),
+		Attempts:        attempts,
+		Time:            time.Now(),
+	}
+	if _, loaded := m.deadLetters.LoadOrStore(follower+"/"+key, entry); loaded {
+		m.deadLetters.Store(follower+"/"+key, entry)
+	} else {
+		DeadLetterCount.WithLabelValues(m.config.Name, follower).Inc()
+	}
+	m.logger.WithField("follower", follower).Warnf("Giving up %v after %d attempts: %v", key, attempts, err)
+}
+
+// forgetDeadLetter 资源同步成功后移出死信
+func (m *mirrorController) forgetDeadLetter(follower, key string) {
+	if _, ok := m.deadLetters.LoadAndDelete(follower + "/" + key); ok {
+		DeadLetterCount.WithLabelValues(m.config.Name, follower).Dec()
+	}
+}
+
+// deadLettered 判断资源在从集群中是否已移入死信
+func (m *mirrorController) deadLettered(follower, key string) bool {
+	_, ok := m.deadLetters.Load(follower + "/" + key)
+	return ok
+}
+
+// skipDeadLetter 判断是否跳过死信中的资源。主集群中的资源版本变化后重新同步
+func (m *mirrorController) skipDeadLetter(follower, key string) bool {
+	v, ok := m.deadLetters.Load(follower + "/" + key)
+	return ok && v.(*DeadLetter).ResourceVersion == m.sourceVersion(key)
+}
+
+// sourceVersion 返回主集群缓存中资源的版本，资源不存在时返回空
+func (m *mirrorController) sourceVersion(key string) string {
+	if o, exists, err := m.indexer.GetByKey(key); err == nil && exists {
+		return o.(*unstructured.Unstructured).GetResourceVersion()
+	}
+	return ""
+}
+
+// DeadLetters 返回所有死信
+func DeadLetters() []DeadLetter {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var res []DeadLetter
+	for _, c := range clusterMap {
+		for _, m := range c.mirrors {
+			m.deadLetters.Range(func(_, v interface{}) bool {
+				res = append(res, *v.(*DeadLetter))
+				return true
+			})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Time.Before(res[j].Time)
+	})
+	return res
+}
+
+// RetryDeadLetter 将死信重新放入从集群的队列
+func RetryDeadLetter(id string) bool {
+	return takeDeadLetter(id, true)
+}
+
+// DiscardDeadLetter 丢弃死信，资源再次变化时仍会同步
+func DiscardDeadLetter(id string) bool {
+	return takeDeadLetter(id, false)
+}
+
+func takeDeadLetter(id string, retry bool) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, c := range clusterMap {
+		for _, m := range c.mirrors {
+			var found *DeadLetter
+			m.deadLetters.Range(func(_, v interface{}) bool {
+				if entry := v.(*DeadLetter); entry.ID == id {
+					found = entry
+					return false
+				}
+				return true
+			})
+			if found == nil {
+				continue
+			}
+			m.forgetDeadLetter(found.Follower, found.Key)
+			if queue, ok := m.followerQueues[found.Follower]; ok && retry {
+				queue.Add(found.Key)
+			}
+			return true
+		}
+	}
+	return false
+}
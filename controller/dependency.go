@@ -0,0 +1,330 @@
+package filter
+
+import (
+	"context"
+	"soul-mirror/model"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+)
+
+// remoteDependencyInterval 等待其他副本同步的依赖时重新检查的间隔
+const remoteDependencyInterval = 10 * time.Second
+
+var (
+	heldMutex = sync.Mutex{}
+	// 等待依赖就绪的资源，key为 从集群/依赖
+	held = make(map[string]map[*mirrorController]map[string]struct{})
+	// 每个从集群的依赖，key为从集群
+	dependencies atomic.Value
+	remoteMutex  = sync.Mutex{}
+	// 由其他副本同步的依赖的检查结果，key为 从集群/依赖
+	remoteDependencies = make(map[string]*remoteDependency)
+)
+
+func isNamespaceMirror(m *mirrorController) bool {
+	return m.gvr.Group == namespaceGVR.Group && m.gvr.Resource == namespaceGVR.Resource
+}
+
+func isCRDMirror(m *mirrorController) bool {
+	return m.gvr.Group == crdGVR.Group && m.gvr.Resource == crdGVR.Resource
+}
+
+// followerDependencies 同步到一个从集群的命名空间和CRD的mirror
+type followerDependencies struct {
+	local []*mirrorController
+	// 由其他副本负责的mirror
+	remote []remoteMirror
+}
+
+// updateDependencies mirror变化后重新计算每个从集群的依赖，同步资源时不需要加全局锁。调用时需要持有全局锁
+func updateDependencies() {
+	res := make(map[string]*followerDependencies)
+	get := func(follower string) *followerDependencies {
+		if _, ok := res[follower]; !ok {
+			res[follower] = &followerDependencies{}
+		}
+		return res[follower]
+	}
+	for _, c := range clusterMap {
+		for _, m := range c.mirrors {
+			if !isNamespaceMirror(m) && !isCRDMirror(m) {
+				continue
+			}
+			for _, follower := range m.config.Config.Clusters.Follower {
+				get(follower).local = append(get(follower).local, m)
+			}
+		}
+		for _, obj := range c.desired {
+			dep := remoteMirror{main: c, config: obj}
+			if c.running(obj) || (!dep.syncs(namespaceGVR) && !dep.syncs(crdGVR)) {
+				continue
+			}
+			for _, follower := range obj.Config.Clusters.Follower {
+				get(follower).remote = append(get(follower).remote, dep)
+			}
+		}
+	}
+	dependencies.Store(res)
+}
+
+func followerDependenciesOf(cluster string) *followerDependencies {
+	deps, _ := dependencies.Load().(map[string]*followerDependencies)
+	if d, ok := deps[cluster]; ok {
+		return d
+	}
+	return &followerDependencies{}
+}
+
+// unmetDependency 返回资源在从集群中尚未就绪的依赖。
+// 只有同样被同步到该从集群的命名空间和CRD才视为依赖，其他情况由 createNamespace 或人工保证
+func (m *mirrorController) unmetDependency(cluster *cluster, obj *unstructured.Unstructured) string {
+	deps := followerDependenciesOf(cluster.name)
+	for _, dep := range deps.local {
+		if dep == m {
+			continue
+		}
+		switch {
+		case isNamespaceMirror(dep) && len(obj.GetNamespace()) > 0 && !isNamespaceMirror(m):
+			if dep.willSync(obj.GetNamespace()) && !dep.ready(cluster, obj.GetNamespace()) {
+				return "namespace/" + obj.GetNamespace()
+			}
+		case isCRDMirror(dep) && !isCRDMirror(m):
+			name := m.gvr.Resource + "." + m.gvr.Group
+			if dep.willSync(name) && !dep.ready(cluster, name) {
+				return "crd/" + name
+			}
+		}
+	}
+	if len(obj.GetNamespace()) > 0 && !isNamespaceMirror(m) && deps.remoteSyncs(namespaceGVR) {
+		if !remoteReady(cluster, namespaceGVR, obj.GetNamespace()) {
+			return "namespace/" + obj.GetNamespace()
+		}
+	}
+	if !isCRDMirror(m) && deps.remoteSyncs(crdGVR) {
+		name := m.gvr.Resource + "." + m.gvr.Group
+		if !remoteReady(cluster, crdGVR, name) {
+			return "crd/" + name
+		}
+	}
+	return ""
+}
+
+func (d *followerDependencies) remoteSyncs(gvr schema.GroupVersionResource) bool {
+	for _, dep := range d.remote {
+		if dep.syncs(gvr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteMirror 由其他副本负责的mirror，没有本地缓存，直接读取集群中的资源
+type remoteMirror struct {
+	main   *cluster
+	config model.Mirror
+}
+
+// syncs 判断mirror是否同步该资源类型，不区分版本
+func (r remoteMirror) syncs(gvr schema.GroupVersionResource) bool {
+	for _, res := range r.config.Resources {
+		if res.Group == gvr.Group && res.Kind == gvr.Resource {
+			return true
+		}
+	}
+	return false
+}
+
+// willSync 判断主集群中是否有该名字的资源符合mirror的条件
+func (r remoteMirror) willSync(ctx context.Context, gvr schema.GroupVersionResource, name string) bool {
+	if len(r.config.Config.TargetName) > 0 && r.config.Config.TargetName != name {
+		return false
+	}
+	obj, err := r.main.client.Resource(gvr).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false
+	}
+	selector, err := metav1.LabelSelectorAsSelector(r.config.Selector)
+	if err != nil || r.config.Selector == nil {
+		return true
+	}
+	return selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// remoteDependency 由其他副本同步的依赖在从集群中最近一次的检查结果
+type remoteDependency struct {
+	ready    bool
+	checked  time.Time
+	checking bool
+}
+
+// remoteReady 返回由其他副本同步的依赖是否已经就绪。同步资源时只读取缓存的检查结果，
+// 结果超过 remoteDependencyInterval 时在后台重新检查
+func remoteReady(cluster *cluster, gvr schema.GroupVersionResource, name string) bool {
+	dep := dependencyName(gvr, name)
+	id := cluster.name + "/" + dep
+	remoteMutex.Lock()
+	defer remoteMutex.Unlock()
+	state, ok := remoteDependencies[id]
+	if !ok {
+		state = &remoteDependency{}
+		remoteDependencies[id] = state
+	}
+	if !state.checking && time.Since(state.checked) > remoteDependencyInterval {
+		state.checking = true
+		go recheck(cluster, gvr, name, state)
+	}
+	return state.ready
+}
+
+// recheck 直接读取主集群和从集群检查依赖。其他副本同步的依赖不会触发本地缓存的事件，
+// 就绪时释放等待该依赖的资源，否则定期释放让资源重新检查
+func recheck(cluster *cluster, gvr schema.GroupVersionResource, name string, state *remoteDependency) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteDependencyInterval)
+	defer cancel()
+	ready := true
+	for _, dep := range followerDependenciesOf(cluster.name).remote {
+		for _, r := range dep.config.Resources {
+			res := schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Kind}
+			if res.GroupResource() == gvr.GroupResource() && dep.willSync(ctx, res, name) && !liveReady(ctx, cluster, res, name) {
+				ready = false
+			}
+		}
+	}
+	remoteMutex.Lock()
+	state.ready, state.checked, state.checking = ready, time.Now(), false
+	remoteMutex.Unlock()
+
+	dep := dependencyName(gvr, name)
+	if ready {
+		release(cluster.name, dep)
+		return
+	}
+	time.AfterFunc(remoteDependencyInterval, func() {
+		release(cluster.name, dep)
+	})
+}
+
+func dependencyName(gvr schema.GroupVersionResource, name string) string {
+	if gvr.GroupResource() == crdGVR.GroupResource() {
+		return "crd/" + name
+	}
+	return "namespace/" + name
+}
+
+// liveReady 直接读取从集群判断依赖是否已经可用
+func liveReady(ctx context.Context, cluster *cluster, gvr schema.GroupVersionResource, name string) bool {
+	obj, err := cluster.client.Resource(gvr).Get(ctx, name, metav1.GetOptions{})
+	return err == nil && dependencyID(obj) != ""
+}
+
+// willSync 判断主集群中是否有该名字的资源需要同步
+func (m *mirrorController) willSync(name string) bool {
+	o, exists, err := m.indexer.GetByKey(name)
+	if err != nil || !exists {
+		return false
+	}
+	obj, ok := o.(*unstructured.Unstructured)
+	return ok && m.match(obj)
+}
+
+// ready 判断依赖在从集群中是否已经可用，CRD需要处于 Established 状态
+func (m *mirrorController) ready(cluster *cluster, name string) bool {
+	lister := m.getTargetLister(cluster)
+	if lister == nil {
+		return false
+	}
+	obj, err := lister.Get(name)
+	if err != nil {
+		return false
+	}
+	return dependencyID(obj) != ""
+}
+
+// dependencyID 返回已就绪的依赖的标识，未就绪时返回空
+func dependencyID(obj *unstructured.Unstructured) string {
+	if obj.GetDeletionTimestamp() != nil {
+		return ""
+	}
+	switch obj.GetKind() {
+	case "Namespace":
+		return "namespace/" + obj.GetName()
+	case "CustomResourceDefinition":
+		conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		for _, c := range conditions {
+			condition, ok := c.(map[string]interface{})
+			if ok && condition["type"] == "Established" && condition["status"] == "True" {
+				return "crd/" + obj.GetName()
+			}
+		}
+	}
+	return ""
+}
+
+// hold 暂存等待依赖的资源，依赖就绪后重新放入队列，而不是按失败重试
+func (m *mirrorController) hold(cluster *cluster, dep, key string) {
+	heldMutex.Lock()
+	id := cluster.name + "/" + dep
+	if _, ok := held[id]; !ok {
+		held[id] = make(map[*mirrorController]map[string]struct{})
+	}
+	if _, ok := held[id][m]; !ok {
+		held[id][m] = make(map[string]struct{})
+	}
+	held[id][m][key] = struct{}{}
+	heldMutex.Unlock()
+	m.logger.WithField("follower", cluster.name).Debugf("holding %s until %s is ready", key, dep)
+	EventHandleCount.WithLabelValues(m.config.Name, "held", cluster.name).Inc()
+}
+
+// release 依赖就绪后，将等待它的资源重新放入该从集群的队列
+func release(cluster, dep string) {
+	heldMutex.Lock()
+	waiting := held[cluster+"/"+dep]
+	delete(held, cluster+"/"+dep)
+	heldMutex.Unlock()
+	for m, keys := range waiting {
+		queue, ok := m.followerQueues[cluster]
+		if !ok {
+			continue
+		}
+		for key := range keys {
+			queue.Add(key)
+		}
+	}
+}
+
+func heldCount() int {
+	heldMutex.Lock()
+	defer heldMutex.Unlock()
+	count := 0
+	for _, waiting := range held {
+		for _, keys := range waiting {
+			count += len(keys)
+		}
+	}
+	return count
+}
+
+// dependencyHandler 监听从集群中的命名空间和CRD，就绪时释放等待的资源
+func dependencyHandler(cluster string) cache.ResourceEventHandler {
+	onReady := func(obj interface{}) {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			if dep := dependencyID(u); dep != "" {
+				release(cluster, dep)
+			}
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: onReady,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			onReady(newObj)
+		},
+	}
+}
@@ -0,0 +1,286 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Change 资源中一个字段的变化
+type Change struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// diff 逐字段比较两个资源，数组作为整体比较
+func diff(path string, live, desired interface{}) []Change {
+	l, lok := live.(map[string]interface{})
+	d, dok := desired.(map[string]interface{})
+	if lok && dok {
+		keys := make([]string, 0, len(l)+len(d))
+		for k := range l {
+			keys = append(keys, k)
+		}
+		for k := range d {
+			if _, ok := l[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		var changes []Change
+		for _, k := range keys {
+			p := k
+			if len(path) > 0 {
+				p = path + "." + k
+			}
+			lv, lin := l[k]
+			dv, din := d[k]
+			switch {
+			case !din:
+				changes = append(changes, Change{Path: p, Op: "remove", Old: lv})
+			case !lin:
+				changes = append(changes, Change{Path: p, Op: "add", New: dv})
+			default:
+				changes = append(changes, diff(p, lv, dv)...)
+			}
+		}
+		return changes
+	}
+	if reflect.DeepEqual(live, desired) {
+		return nil
+	}
+	return []Change{{Path: path, Op: "replace", Old: live, New: desired}}
+}
+
+// ObjectDiff 主集群中的一个资源与从集群中对应资源的差异
+type ObjectDiff struct {
+	Main     string   `json:"main"`
+	Follower string   `json:"follower"`
+	Resource string   `json:"resource"`
+	Key      string   `json:"key"`
+	State    string   `json:"state"`
+	Changes  []Change `json:"changes,omitempty"`
+
+	live, desired map[string]interface{}
+}
+
+// MirrorDiff 返回mirror中所有与从集群不一致的资源
+func MirrorDiff(name string) ([]ObjectDiff, bool) {
+	var res []ObjectDiff
+	found := false
+	for _, m := range mirrorsByName(name) {
+		found = true
+		for _, o := range m.indexer.List() {
+			obj, ok := o.(*unstructured.Unstructured)
+			if !ok || !m.match(obj) {
+				continue
+			}
+			for _, d := range m.objectDiffs(obj) {
+				if d.State != "synced" {
+					res = append(res, d)
+				}
+			}
+		}
+	}
+	return res, found
+}
+
+// ObjectDiffs 返回mirror中指定资源在每个从集群中的差异
+func ObjectDiffs(name, namespace, objName string) ([]ObjectDiff, bool) {
+	key := objName
+	if len(namespace) > 0 {
+		key = namespace + "/" + objName
+	}
+	var res []ObjectDiff
+	found := false
+	for _, m := range mirrorsByName(name) {
+		o, exists, err := m.indexer.GetByKey(key)
+		if err != nil || !exists {
+			continue
+		}
+		found = true
+		res = append(res, m.objectDiffs(o.(*unstructured.Unstructured))...)
+	}
+	return res, found
+}
+
+// mirrorsByName 在锁内取出mirror，比较在锁外进行，不阻塞配置更新
+func mirrorsByName(name string) []*mirrorController {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var res []*mirrorController
+	for _, c := range clusterMap {
+		for _, m := range c.mirrors {
+			if m.config.Name == name {
+				res = append(res, m)
+			}
+		}
+	}
+	return res
+}
+
+func (m *mirrorController) objectDiffs(obj *unstructured.Unstructured) []ObjectDiff {
+	src, _ := json.Marshal(obj)
+	var res []ObjectDiff
+	for _, clusterName := range m.config.Config.Clusters.Follower {
+		cluster, ok := clusterMap[clusterName]
+		if !ok || m.getTargetLister(cluster) == nil {
+			continue
+		}
+		d := ObjectDiff{
+			Main:     m.config.Config.Clusters.Main,
+			Follower: clusterName,
+			Resource: m.gvr.String(),
+			Key:      m.fmtMeta(obj),
+		}
+		target, err := m.getTargetLister(cluster).Get(m.fmtMeta(obj))
+		if err != nil {
+			d.State = "missing"
+			d.live = map[string]interface{}{}
+			d.desired = m.normalize(m.filter(src, []byte{}))
+		} else {
+			res, _, state := m.compare(src, target)
+			if m.config.Config.MetadataOnlyCache && state != stateSynced {
+				// 缓存中只有元数据，读取完整的资源
+				if live, err := m.getTargetClient(cluster, obj).Get(m.ctx, target.GetName(), metav1.GetOptions{}); err == nil {
+					target = live
+					res, _, state = m.compare(src, target)
+				}
+			}
+			d.State = map[syncState]string{stateSynced: "synced", stateChanged: "changed", stateDrifted: "drifted"}[state]
+			live, _ := json.Marshal(target)
+			d.live = m.normalize(live)
+			d.desired = m.normalize(res)
+			if m.config.Config.MetadataOnlyCache && state == stateSynced {
+				d.live = d.desired
+			}
+		}
+		d.Changes = diff("", d.live, d.desired)
+		res = append(res, d)
+	}
+	return res
+}
+
+// Unified 以统一diff格式输出从集群中的资源与期望资源的差异，差异过大时输出json格式的 Changes
+func (d ObjectDiff) Unified() string {
+	live, _ := json.MarshalIndent(d.live, "", "  ")
+	desired, _ := json.MarshalIndent(d.desired, "", "  ")
+	header := fmt.Sprintf("--- %s/%s %s\n+++ %s/%s %s\n", d.Follower, d.Key, d.Resource, d.Main, d.Key, d.Resource)
+	out, ok := unified(strings.Split(string(live), "\n"), strings.Split(string(desired), "\n"), 3)
+	if !ok {
+		changes, _ := json.MarshalIndent(d.Changes, "", "  ")
+		return header + "# too many changed lines for a unified diff, changes:\n" + string(changes) + "\n"
+	}
+	return header + out
+}
+
+// maxUnifiedCells 最长公共子序列表的大小上限，避免很大的资源占用过多内存
+const maxUnifiedCells = 1 << 22
+
+// unified 基于最长公共子序列逐行比较，输出带有 context 行上下文的差异块。
+// 相同的首尾行不参与计算，其余部分过大时返回 false
+func unified(a, b []string, context int) (string, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(ma)+1)*(len(mb)+1) > maxUnifiedCells {
+		return "", false
+	}
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+		a, b int
+	}
+	var lines []line
+	for k := 0; k < prefix; k++ {
+		lines = append(lines, line{' ', a[k], k, k})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			lines = append(lines, line{' ', ma[i], prefix + i, prefix + j})
+			i++
+			j++
+		case i < len(ma) && (j == len(mb) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', ma[i], prefix + i, prefix + j})
+			i++
+		default:
+			lines = append(lines, line{'+', mb[j], prefix + i, prefix + j})
+			j++
+		}
+	}
+	for k := 0; k < suffix; k++ {
+		lines = append(lines, line{' ', a[len(a)-suffix+k], len(a) - suffix + k, len(b) - suffix + k})
+	}
+
+	var out strings.Builder
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+		// 向前后扩展上下文，相邻的修改合并为一个差异块
+		from := start - context
+		if from < 0 {
+			from = 0
+		}
+		to := start
+		for k := start; k < len(lines) && k <= to+2*context; k++ {
+			if lines[k].op != ' ' {
+				to = k
+			}
+		}
+		to += context
+		if to >= len(lines) {
+			to = len(lines) - 1
+		}
+		var countA, countB int
+		for _, l := range lines[from : to+1] {
+			if l.op != '+' {
+				countA++
+			}
+			if l.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", lines[from].a+1, countA, lines[from].b+1, countB)
+		for _, l := range lines[from : to+1] {
+			out.WriteByte(l.op)
+			out.WriteString(l.text)
+			out.WriteByte('\n')
+		}
+		start = to + 1
+	}
+	return out.String(), true
+}
@@ -0,0 +1,125 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"soul-mirror/model"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type syncState int
+
+const (
+	// 从集群中的资源与期望状态一致
+	stateSynced syncState = iota
+	// 主集群中的资源发生了变化
+	stateChanged
+	// 从集群中的资源被其他人修改
+	stateDrifted
+)
+
+// compare 计算期望写入从集群的资源，并根据内容摘要判断从集群中的资源是否需要更新。
+// 摘要记录在从集群资源的注解上，不依赖 resourceVersion，因此主集群重建后依然可以正常同步
+func (m *mirrorController) compare(srcJson []byte, targetObject *unstructured.Unstructured) ([]byte, string, syncState) {
+	target, _ := json.Marshal(targetObject)
+	res := m.filter(srcJson, target)
+	desired := m.normalize(res)
+	hash := contentHash(desired)
+	if targetObject.GetAnnotations()[model.ContentHashAnnotation] != hash {
+		return res, hash, stateChanged
+	}
+	// 只缓存元数据时无法检查漂移
+	if m.config.Config.DriftPolicy == model.DriftPolicyIgnore || m.config.Config.MetadataOnlyCache || contains(m.normalize(target), desired) {
+		return res, hash, stateSynced
+	}
+	return res, hash, stateDrifted
+}
+
+// normalize 去掉由集群维护或由从集群保留的字段，剩下的内容用于比较
+func (m *mirrorController) normalize(obj []byte) map[string]interface{} {
+	content := make(map[string]interface{})
+	_ = json.Unmarshal(obj, &content)
+	for _, key := range defaultIgnore {
+		unstructured.RemoveNestedField(content, strings.Split(key, ".")...)
+	}
+	for _, filter := range m.config.Filter {
+		if filter.Action == "replace" {
+			unstructured.RemoveNestedField(content, strings.Split(filter.Key, ".")...)
+		}
+	}
+	namespace, _, _ := unstructured.NestedString(content, "metadata", "namespace")
+	name, _, _ := unstructured.NestedString(content, "metadata", "name")
+	for _, key := range m.ignoredPaths(namespace, name) {
+		unstructured.RemoveNestedField(content, strings.Split(key, ".")...)
+	}
+	return content
+}
+
+// writtenHash 只去掉由集群维护的字段，不依赖mirror的配置，其他mirror和重启后的进程据此判断资源写入后是否被修改
+func writtenHash(obj []byte) string {
+	content := make(map[string]interface{})
+	_ = json.Unmarshal(obj, &content)
+	for _, key := range defaultIgnore {
+		unstructured.RemoveNestedField(content, strings.Split(key, ".")...)
+	}
+	return contentHash(content)
+}
+
+func contentHash(content map[string]interface{}) string {
+	// map 序列化时key有序，结果稳定
+	b, _ := json.Marshal(content)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// contains 判断 live 是否包含 desired 中的所有字段。
+// 从集群中由apiserver填充的默认值不在 desired 中，因此不会被视为漂移
+func contains(live, desired interface{}) bool {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range d {
+			lv, ok := l[k]
+			if !ok && isEmpty(v) {
+				// apiserver 会丢弃空字段
+				continue
+			}
+			if !ok || !contains(lv, v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return false
+		}
+		for i := range d {
+			if !contains(l[i], d[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(live, desired)
+	}
+}
+
+func isEmpty(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		return len(t) == 0
+	case []interface{}:
+		return len(t) == 0
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package filter
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func decode(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestContains(t *testing.T) {
+	tests := []struct {
+		name    string
+		live    string
+		desired string
+		want    bool
+	}{
+		{
+			name:    "equal",
+			live:    `{"spec":{"replicas":1}}`,
+			desired: `{"spec":{"replicas":1}}`,
+			want:    true,
+		},
+		{
+			name:    "apiserver defaulted fields",
+			live:    `{"spec":{"replicas":1,"revisionHistoryLimit":10,"strategy":{"type":"RollingUpdate"}}}`,
+			desired: `{"spec":{"replicas":1}}`,
+			want:    true,
+		},
+		{
+			name:    "defaulted fields in list items",
+			live:    `{"ports":[{"port":80,"protocol":"TCP"}]}`,
+			desired: `{"ports":[{"port":80}]}`,
+			want:    true,
+		},
+		{
+			name:    "empty fields dropped by apiserver",
+			live:    `{"metadata":{"name":"a"}}`,
+			desired: `{"metadata":{"name":"a","labels":{}},"data":null}`,
+			want:    true,
+		},
+		{
+			name:    "changed value",
+			live:    `{"spec":{"replicas":2}}`,
+			desired: `{"spec":{"replicas":1}}`,
+		},
+		{
+			name:    "missing field",
+			live:    `{"data":{}}`,
+			desired: `{"data":{"key":"value"}}`,
+		},
+		{
+			name:    "extra list item",
+			live:    `{"ports":[{"port":80},{"port":443}]}`,
+			desired: `{"ports":[{"port":80}]}`,
+		},
+		{
+			name:    "type changed",
+			live:    `{"data":"value"}`,
+			desired: `{"data":{"key":"value"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contains(decode(t, tt.live), decode(t, tt.desired)); got != tt.want {
+				t.Errorf("contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package filter
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+var dryRun bool
+
+// SetDryRun 开启后所有mirror都不会写入从集群，只记录将要发生的变化
+func SetDryRun(enabled bool) {
+	dryRun = enabled
+}
+
+// DryRunRecord 试运行时一次同步将要对从集群做的修改
+type DryRunRecord struct {
+	Resource string    `json:"resource"`
+	Follower string    `json:"follower"`
+	Key      string    `json:"key"`
+	Action   string    `json:"action"`
+	Time     time.Time `json:"time"`
+	Changes  []Change  `json:"changes,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (m *mirrorController) dryRun() bool {
+	return dryRun || m.config.Config.DryRun
+}
+
+// recordDryRun 记录试运行的结果。desired 优先使用apiserver试运行返回的资源，包含默认值和准入插件的修改
+func (m *mirrorController) recordDryRun(cluster *cluster, action, key string, live, desired []byte, err error) {
+	record := &DryRunRecord{
+		Resource: m.gvr.String(),
+		Follower: cluster.name,
+		Key:      key,
+		Action:   action,
+		Time:     time.Now(),
+		Changes:  diff("", m.normalize(live), m.normalize(desired)),
+	}
+	logger := m.logger.WithField("to", cluster.name)
+	if err != nil {
+		record.Error = err.Error()
+		logger.WithError(err).Warnf("dry run: failed to %s %s", action, key)
+		EventHandleErrorCount.WithLabelValues(m.config.Name, action, string(errors.ReasonForError(err)), cluster.name).Inc()
+	}
+	changes, _ := json.Marshal(record.Changes)
+	logger.WithField("changes", string(changes)).Infof("dry run: would %s %s", action, key)
+	EventHandleCount.WithLabelValues(m.config.Name, "dry_run_"+action, cluster.name).Inc()
+	m.dryRuns.Store(cluster.name+"/"+key, record)
+}
+
+// DryRuns 返回mirror试运行时每个资源在每个从集群中最近一次将要发生的变化
+func DryRuns(name string) ([]DryRunRecord, bool) {
+	mirrors := mirrorsByName(name)
+	if len(mirrors) == 0 {
+		return nil, false
+	}
+	res := []DryRunRecord{}
+	for _, m := range mirrors {
+		m.dryRuns.Range(func(_, v interface{}) bool {
+			res = append(res, *v.(*DryRunRecord))
+			return true
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Time.After(res[j].Time)
+	})
+	return res, true
+}
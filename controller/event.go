@@ -0,0 +1,53 @@
+package filter
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	reasonSynced = "MirrorSynced"
+	reasonFailed = "MirrorFailed"
+)
+
+// setRecorder 为集群创建事件记录器，替换之前的记录器
+func (c *cluster) setRecorder() error {
+	client, err := kubernetes.NewForConfig(c.config)
+	if err != nil {
+		return err
+	}
+	if c.broadcaster != nil {
+		c.broadcaster.Shutdown()
+	}
+	c.broadcaster = record.NewBroadcaster()
+	c.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	c.recorder = c.broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "soul-mirror"})
+	return nil
+}
+
+// eventSynced 资源写入从集群后，在主集群的资源上记录事件，按配置在从集群的资源上也记录事件
+func (m *mirrorController) eventSynced(cluster *cluster, srcObject, targetObject *unstructured.Unstructured, action string) {
+	if m.config.Config.DisableEvents {
+		return
+	}
+	if main, ok := clusterMap[m.config.Config.Clusters.Main]; ok && main.recorder != nil {
+		main.recorder.Eventf(srcObject, corev1.EventTypeNormal, reasonSynced, "%s in follower %s by mirror %s", action, cluster.name, m.config.Name)
+	}
+	if m.config.Config.FollowerEvents && targetObject != nil && cluster.recorder != nil {
+		cluster.recorder.Eventf(targetObject, corev1.EventTypeNormal, reasonSynced, "%s from %s by mirror %s", action, m.config.Config.Clusters.Main, m.config.Name)
+	}
+}
+
+// eventFailed 同步失败时在主集群的资源上记录事件
+func (m *mirrorController) eventFailed(follower string, srcObject *unstructured.Unstructured, err error) {
+	if m.config.Config.DisableEvents {
+		return
+	}
+	if main, ok := clusterMap[m.config.Config.Clusters.Main]; ok && main.recorder != nil {
+		main.recorder.Eventf(srcObject, corev1.EventTypeWarning, reasonFailed, "failed to sync to follower %s by mirror %s: %v", follower, m.config.Name, err)
+	}
+}
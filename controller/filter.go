@@ -43,9 +43,39 @@ func (m *mirrorController) filter(src, target []byte) []byte {
 			logrus.Warnf("Unexpected filter action on %v: %v", m.config.Name, filter.Action)
 		}
 	}
+
+	// 从集群中由其他组件修改的字段保留从集群中的值
+	if len(target) > 0 {
+		namespace, _ := jsonparser.GetString(src, "metadata", "namespace")
+		name, _ := jsonparser.GetString(src, "metadata", "name")
+		for _, key := range m.ignoredPaths(namespace, name) {
+			src = replace(key, []byte{}, src, target)
+		}
+	}
 	return src
 }
 
+// ignoredPaths 返回对指定资源生效的 ignoreDifferences 字段
+func (m *mirrorController) ignoredPaths(namespace, name string) []string {
+	var paths []string
+	for _, rule := range m.config.IgnoreDifferences {
+		if len(rule.Group) > 0 && rule.Group != m.gvr.Group {
+			continue
+		}
+		if len(rule.Kind) > 0 && rule.Kind != m.gvr.Resource {
+			continue
+		}
+		if len(rule.Namespace) > 0 && rule.Namespace != namespace {
+			continue
+		}
+		if len(rule.Name) > 0 && rule.Name != name {
+			continue
+		}
+		paths = append(paths, rule.Paths...)
+	}
+	return paths
+}
+
 func replace(key string, defaultValue, src, target []byte) []byte {
 	path := strings.Split(key, ".")
 	v, datatype, offset, err := jsonparser.Get(target, path...)
@@ -1,10 +1,8 @@
 package filter
 
 import (
-	"context"
 	"encoding/json"
 	"soul-mirror/model"
-	"strconv"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -16,32 +14,12 @@ import (
 )
 
 func (m *mirrorController) genHandler() cache.ResourceEventHandler {
-	selector, _ := metav1.LabelSelectorAsSelector(m.config.Selector)
-	if m.config.Selector == nil {
-		selector = labels.Everything()
-	}
-	match := func(object *unstructured.Unstructured) bool {
-		if len(m.config.Config.Namespace) > 0 && object.GetNamespace() != m.config.Config.Namespace {
-			return false
-		}
-		if len(m.config.Config.NotInNamespace) > 0 && object.GetNamespace() == m.config.Config.NotInNamespace {
-			return false
-		}
-		if !selector.Matches(labels.Set(object.GetLabels())) {
-			return false
-		}
-		if len(m.config.Config.TargetName) > 0 && object.GetName() != m.config.Config.TargetName {
-			return false
-		}
-		return true
-	}
-
 	return cache.ResourceEventHandlerFuncs{AddFunc: func(obj interface{}) {
 		if !m.config.Config.SyncCreate {
 			return
 		}
 		object := obj.(*unstructured.Unstructured)
-		if !match(object) {
+		if !m.match(object) {
 			return
 		}
 		key, err := cache.MetaNamespaceKeyFunc(obj)
@@ -50,7 +28,7 @@ func (m *mirrorController) genHandler() cache.ResourceEventHandler {
 		}
 	}, UpdateFunc: func(oldObj, newObj interface{}) {
 		obj := newObj.(*unstructured.Unstructured)
-		if !match(obj) {
+		if !m.match(obj) {
 			return
 		}
 		key, err := cache.MetaNamespaceKeyFunc(obj)
@@ -58,36 +36,106 @@ func (m *mirrorController) genHandler() cache.ResourceEventHandler {
 			m.queue.Add(key)
 		}
 	}, DeleteFunc: func(obj interface{}) {
-		if !m.config.Config.SyncDelete {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
 			return
 		}
-		object := obj.(*unstructured.Unstructured)
-		if !match(object) {
+		if c, ok := clusterMap[m.config.Config.Clusters.Main]; ok {
+			m.forgetWrite(c, key)
+		}
+		m.dropReferences(key)
+		if !m.config.Config.SyncDelete {
 			return
 		}
-		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
-		if err == nil {
+		object, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+			if !ok {
+				return
+			}
+			if object, ok = tombstone.Obj.(*unstructured.Unstructured); !ok {
+				return
+			}
+		}
+		if m.match(object) {
 			m.queue.Add(key)
 		}
 	}}
 }
 
-func (m *mirrorController) delete(cluster *cluster, key string) error {
+func (m *mirrorController) match(object *unstructured.Unstructured) bool {
+	if m.refs != nil {
+		return m.refs.has(m.fmtMeta(object))
+	}
+	if ns := namespaces(m.config.Config); m.namespaced && len(ns) > 0 && !inNamespaces(ns, object.GetNamespace()) {
+		return false
+	}
+	if m.namespaced && len(m.config.Config.NotInNamespace) > 0 && object.GetNamespace() == m.config.Config.NotInNamespace {
+		return false
+	}
+	if !m.selector.Matches(labels.Set(object.GetLabels())) {
+		return false
+	}
+	if len(m.config.Config.TargetName) > 0 && object.GetName() != m.config.Config.TargetName {
+		return false
+	}
+	return true
+}
+
+// leftSelector 按标签过滤list/watch时，资源的标签不再匹配 selector 也会收到删除事件。
+// 主集群中的资源仍然存在时不删除从集群的资源
+func (m *mirrorController) leftSelector(key string) (bool, error) {
+	if m.selector.Empty() {
+		return false, nil
+	}
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return false, nil
+	}
+	var client dynamic.ResourceInterface = m.client.Resource(m.gvr)
+	if len(ns) > 0 {
+		client = m.client.Resource(m.gvr).Namespace(ns)
+	}
+	_, err = client.Get(m.ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// delete 删除从集群中的资源，返回是否实际写入了从集群
+func (m *mirrorController) delete(cluster *cluster, key string) (bool, error) {
 	client := m.getTargetClientFromKey(cluster, key)
 	_, name, _ := cache.SplitMetaNamespaceKey(key)
-	err := client.Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if m.dryRun() {
+		live, err := m.getTargetLister(cluster).Get(key)
+		if err != nil {
+			return false, nil
+		}
+		cluster.throttle()
+		err = client.Delete(m.ctx, name, metav1.DeleteOptions{DryRun: []string{metav1.DryRunAll}})
+		target, _ := json.Marshal(live)
+		m.recordDryRun(cluster, "delete", key, target, nil, err)
+		return false, nil
+	}
+	cluster.throttle()
+	err := client.Delete(m.ctx, name, metav1.DeleteOptions{})
 	if errors.IsNotFound(err) {
-		return nil
+		m.forgetWrite(cluster, key)
+		return false, nil
 	} else if err != nil {
 		m.logger.WithField("to", cluster.name).WithError(err).Errorf("failed to delete %s", key)
-		EventHandleErrorCount.WithLabelValues(m.config.Name, "delete", string(errors.ReasonForError(err))).Inc()
-		return err
+		EventHandleErrorCount.WithLabelValues(m.config.Name, "delete", string(errors.ReasonForError(err)), cluster.name).Inc()
+		return false, err
 	}
-	EventHandleCount.WithLabelValues(m.config.Name, "deleted").Inc()
-	return nil
+	m.forgetWrite(cluster, key)
+	EventHandleCount.WithLabelValues(m.config.Name, "deleted", cluster.name).Inc()
+	ns, _, _ := cache.SplitMetaNamespaceKey(key)
+	m.collectNamespace(cluster, ns)
+	return true, nil
 }
 
-func (m *mirrorController) add(cluster *cluster, srcJson []byte, srcObject *unstructured.Unstructured) error {
+func (m *mirrorController) add(cluster *cluster, srcJson []byte, srcObject *unstructured.Unstructured) (bool, error) {
 	client := m.getTargetClient(cluster, srcObject)
 	res := m.filter(srcJson, []byte{})
 	resObject := &unstructured.Unstructured{}
@@ -98,61 +146,140 @@ func (m *mirrorController) add(cluster *cluster, srcJson []byte, srcObject *unst
 		annotation = make(map[string]string)
 	}
 	annotation[model.ResourceVersionAnnotation] = srcObject.GetResourceVersion()
+	annotation[model.ContentHashAnnotation] = contentHash(m.normalize(res))
+	annotation[model.WrittenHashAnnotation] = writtenHash(res)
+	if m.bidirectional() {
+		setRevision(annotation, m.revisionOf(m.config.Config.Clusters.Main, srcObject))
+	} else {
+		setPath(annotation, m.mirrorPath(srcObject))
+	}
 	resObject.SetAnnotations(annotation)
 
-	_, err := client.Create(context.TODO(), resObject, metav1.CreateOptions{})
+	if m.dryRun() {
+		cluster.throttle()
+		created, err := client.Create(m.ctx, resObject, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+		if err == nil {
+			res, _ = json.Marshal(created)
+		}
+		m.recordDryRun(cluster, "add", m.fmtMeta(resObject), nil, res, err)
+		return false, nil
+	}
+	cluster.throttle()
+	created, err := client.Create(m.ctx, resObject, metav1.CreateOptions{})
+	if namespaceMissing(err) && m.config.Config.CreateNamespace.Enabled {
+		err = m.ensureNamespace(cluster, resObject.GetNamespace())
+		if err == nil {
+			cluster.throttle()
+			created, err = client.Create(m.ctx, resObject, metav1.CreateOptions{})
+		}
+	}
 	if err != nil && !errors.IsAlreadyExists(err) {
 		m.logger.WithField("to", cluster.name).WithError(err).Errorf("failed to create %s", m.fmtMeta(resObject))
-		EventHandleErrorCount.WithLabelValues(m.config.Name, "add", string(errors.ReasonForError(err))).Inc()
-		return err
+		EventHandleErrorCount.WithLabelValues(m.config.Name, "add", string(errors.ReasonForError(err)), cluster.name).Inc()
+		return false, err
+	}
+	m.recordWrite(cluster, created)
+	if err == nil {
+		m.eventSynced(cluster, srcObject, created, "created")
 	}
-	EventHandleCount.WithLabelValues(m.config.Name, "added").Inc()
-	return nil
+	EventHandleCount.WithLabelValues(m.config.Name, "added", cluster.name).Inc()
+	return err == nil, nil
 }
 
-func (m *mirrorController) update(cluster *cluster, srcJson []byte, srcObject *unstructured.Unstructured) error {
+// update 将资源写入从集群，返回是否实际写入了从集群。已同步、只报告漂移和试运行时不写入
+func (m *mirrorController) update(cluster *cluster, srcJson []byte, srcObject *unstructured.Unstructured) (bool, error) {
 	client := m.getTargetClient(cluster, srcObject)
 	targetObject, err := m.getTargetLister(cluster).Get(m.fmtMeta(srcObject))
 	if errors.IsNotFound(err) {
 		return m.add(cluster, srcJson, srcObject)
 	} else if err != nil {
 		m.logger.WithField("to", cluster.name).WithError(err).Errorf("failed to get %s", m.fmtMeta(srcObject))
-		EventHandleErrorCount.WithLabelValues(m.config.Name, "update", string(errors.ReasonForError(err))).Inc()
-		return err
+		EventHandleErrorCount.WithLabelValues(m.config.Name, "update", string(errors.ReasonForError(err)), cluster.name).Inc()
+		return false, err
 	}
 
-	annotation := targetObject.GetAnnotations()
-	if annotation == nil {
-		annotation = make(map[string]string)
+	res, hash, state := m.compare(srcJson, targetObject)
+	if m.config.Config.MetadataOnlyCache && (state != stateSynced || m.bidirectional()) {
+		// 缓存中只有元数据，写入前读取完整的资源
+		targetObject, err = client.Get(m.ctx, targetObject.GetName(), metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return m.add(cluster, srcJson, srcObject)
+		} else if err != nil {
+			return false, err
+		}
+		res, hash, state = m.compare(srcJson, targetObject)
+	}
+	var rev revision
+	if m.bidirectional() {
+		rev = m.revisionOf(m.config.Config.Clusters.Main, srcObject)
+		if !m.resolve(cluster.name, rev, srcObject, targetObject) {
+			m.logger.WithField("to", cluster.name).Debugf("skip older revision %s", m.fmtMeta(srcObject))
+			return false, nil
+		}
+		if state == stateSynced && !sameRevision(rev, targetObject) {
+			state = stateChanged
+		}
 	}
-	targetResVer, _ := strconv.ParseInt(annotation[model.ResourceVersionAnnotation], 10, 64)
-	srcResVer, _ := strconv.ParseInt(srcObject.GetResourceVersion(), 10, 64)
-	if targetResVer >= srcResVer {
+	switch state {
+	case stateSynced:
 		m.logger.WithField("to", cluster.name).Infof("synced version %v %s", srcObject.GetResourceVersion(), m.fmtMeta(srcObject))
-		EventHandleCount.WithLabelValues(m.config.Name, "synced").Inc()
-		return nil
+		EventHandleCount.WithLabelValues(m.config.Name, "synced", cluster.name).Inc()
+		return false, nil
+	case stateDrifted:
+		EventHandleCount.WithLabelValues(m.config.Name, "drifted", cluster.name).Inc()
+		if m.config.Config.DriftPolicy == model.DriftPolicyReport {
+			m.logger.WithField("to", cluster.name).Warnf("drift detected on %s", m.fmtMeta(srcObject))
+			return false, nil
+		}
+		m.logger.WithField("to", cluster.name).Infof("correcting drift on %s", m.fmtMeta(srcObject))
 	}
-	annotation[model.ResourceVersionAnnotation] = strconv.FormatInt(srcResVer, 10)
-	targetObject.SetAnnotations(annotation)
 
-	target, _ := json.Marshal(targetObject)
-	res := m.filter(srcJson, target)
 	resObject := &unstructured.Unstructured{}
 	err = json.Unmarshal(res, resObject)
-	_, err = client.Update(context.TODO(), resObject, metav1.UpdateOptions{})
+	if err != nil {
+		return false, err
+	}
+	annotation := resObject.GetAnnotations()
+	if annotation == nil {
+		annotation = make(map[string]string)
+	}
+	annotation[model.ResourceVersionAnnotation] = srcObject.GetResourceVersion()
+	annotation[model.ContentHashAnnotation] = hash
+	annotation[model.WrittenHashAnnotation] = writtenHash(res)
+	if m.bidirectional() {
+		setRevision(annotation, rev)
+	} else {
+		setPath(annotation, m.mirrorPath(srcObject))
+	}
+	resObject.SetAnnotations(annotation)
+
+	if m.dryRun() {
+		cluster.throttle()
+		updated, err := client.Update(m.ctx, resObject, metav1.UpdateOptions{DryRun: []string{metav1.DryRunAll}})
+		if err == nil {
+			res, _ = json.Marshal(updated)
+		}
+		target, _ := json.Marshal(targetObject)
+		m.recordDryRun(cluster, "update", m.fmtMeta(resObject), target, res, err)
+		return false, nil
+	}
+	cluster.throttle()
+	updated, err := client.Update(m.ctx, resObject, metav1.UpdateOptions{})
 	if err != nil && errors.IsConflict(err) {
 		m.logger.WithField("to", cluster.name).Debugf("failed to update %s : conflict", m.fmtMeta(resObject))
-		EventHandleCount.WithLabelValues(m.config.Name, "conflict").Inc()
-		return err
+		EventHandleCount.WithLabelValues(m.config.Name, "conflict", cluster.name).Inc()
+		return false, err
 	}
 	if err != nil {
 		m.logger.WithField("to", cluster.name).WithError(err).Errorf("failed to update %s", m.fmtMeta(resObject))
 		m.logger.WithField("to", cluster.name).Debugf("failed to update %s : %s", m.fmtMeta(resObject), res)
-		EventHandleErrorCount.WithLabelValues(m.config.Name, "update", string(errors.ReasonForError(err))).Inc()
-		return err
+		EventHandleErrorCount.WithLabelValues(m.config.Name, "update", string(errors.ReasonForError(err)), cluster.name).Inc()
+		return false, err
 	}
-	EventHandleCount.WithLabelValues(m.config.Name, "update").Inc()
-	return nil
+	m.recordWrite(cluster, updated)
+	m.eventSynced(cluster, srcObject, updated, "updated")
+	EventHandleCount.WithLabelValues(m.config.Name, "update", cluster.name).Inc()
+	return true, nil
 }
 
 func (m *mirrorController) getTargetClient(cluster *cluster, object *unstructured.Unstructured) dynamic.ResourceInterface {
@@ -170,8 +297,9 @@ func (m *mirrorController) getTargetClientFromKey(cluster *cluster, key string)
 	return cluster.client.Resource(m.gvr)
 }
 
+// getTargetLister 返回从集群中资源的缓存，不是该mirror的从集群时返回nil
 func (m *mirrorController) getTargetLister(cluster *cluster) dynamiclister.Lister {
-	return cluster.cache[m.String()]
+	return m.listers[cluster.name]
 }
 
 func (m *mirrorController) fmtMeta(obj *unstructured.Unstructured) string {
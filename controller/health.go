@@ -0,0 +1,175 @@
+package filter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	clusterReachable   = "reachable"
+	clusterDegraded    = "degraded"
+	clusterUnreachable = "unreachable"
+
+	probeInterval = 10 * time.Second
+	probeTimeout  = 5 * time.Second
+	// 探测耗时超过该值视为集群降级
+	probeSlow = 2 * time.Second
+	// 连续探测失败达到该次数后熔断，暂停写入该集群
+	probeFailureThreshold = 3
+)
+
+var clusterStates = []string{clusterReachable, clusterDegraded, clusterUnreachable}
+
+// clusterHealth 记录集群apiserver的健康状态，集群不可达时暂存待写入的资源
+type clusterHealth struct {
+	mutex         sync.Mutex
+	state         string
+	since         time.Time
+	failures      int
+	lastError     string
+	serverVersion string
+	// 熔断期间暂停写入的资源
+	parked map[*mirrorController]map[string]struct{}
+}
+
+func newClusterHealth() *clusterHealth {
+	return &clusterHealth{
+		state:  clusterReachable,
+		since:  time.Now(),
+		parked: make(map[*mirrorController]map[string]struct{}),
+	}
+}
+
+// probe 探测apiserver并更新集群的健康状态
+func (c *cluster) probe() (string, error) {
+	mutex.Lock()
+	cfg := rest.CopyConfig(c.config)
+	mutex.Unlock()
+	cfg.Timeout = probeTimeout
+
+	start := time.Now()
+	version := ""
+	client, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err == nil {
+		info, e := client.ServerVersion()
+		if err = e; err == nil {
+			version = info.String()
+		}
+	}
+	c.observe(time.Since(start), version, err)
+	return version, err
+}
+
+func (c *cluster) observe(latency time.Duration, version string, err error) {
+	h := c.health
+	h.mutex.Lock()
+	old := h.state
+	state := clusterReachable
+	if err != nil {
+		h.failures++
+		h.lastError = err.Error()
+		state = clusterDegraded
+		if h.failures >= probeFailureThreshold {
+			state = clusterUnreachable
+		}
+	} else {
+		h.failures = 0
+		h.lastError = ""
+		h.serverVersion = version
+		if latency > probeSlow {
+			state = clusterDegraded
+		}
+	}
+	var parked map[*mirrorController]map[string]struct{}
+	if state != old {
+		h.state = state
+		h.since = time.Now()
+		if old == clusterUnreachable {
+			parked = h.parked
+			h.parked = make(map[*mirrorController]map[string]struct{})
+		}
+	}
+	h.mutex.Unlock()
+
+	for _, s := range clusterStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		ClusterState.WithLabelValues(c.name, s).Set(value)
+	}
+	if state == old {
+		return
+	}
+	logger := logrus.WithField("cluster", c.name)
+	switch state {
+	case clusterUnreachable:
+		logger.Warnf("cluster is unreachable, pausing writes: %v", err)
+	case clusterDegraded:
+		logger.Warnf("cluster is degraded, probe took %v: %v", latency, err)
+	default:
+		logger.Infof("cluster is reachable")
+	}
+	if old == clusterUnreachable {
+		c.unpark(parked)
+	}
+}
+
+// unpark 集群恢复后，将熔断期间暂存的资源批量放入队列重新同步
+func (c *cluster) unpark(parked map[*mirrorController]map[string]struct{}) {
+	count := 0
+	for m, keys := range parked {
+		queue, ok := m.followerQueues[c.name]
+		if !ok {
+			continue
+		}
+		for key := range keys {
+			queue.Add(key)
+			count++
+		}
+	}
+	ParkedObjectCount.WithLabelValues(c.name).Set(0)
+	if count > 0 {
+		logrus.WithField("cluster", c.name).Infof("cluster recovered, reconciling %d parked objects", count)
+	}
+}
+
+// unreachable 判断集群是否处于熔断状态
+func (c *cluster) unreachable() bool {
+	c.health.mutex.Lock()
+	defer c.health.mutex.Unlock()
+	return c.health.state == clusterUnreachable
+}
+
+// park 暂存写入不可达集群的资源，集群恢复后再同步，而不是按失败重试
+func (m *mirrorController) park(c *cluster, key string) bool {
+	h := c.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.state != clusterUnreachable {
+		return false
+	}
+	if _, ok := h.parked[m]; !ok {
+		h.parked[m] = make(map[string]struct{})
+	}
+	if _, ok := h.parked[m][key]; !ok {
+		h.parked[m][key] = struct{}{}
+		ParkedObjectCount.WithLabelValues(c.name).Inc()
+		m.logger.WithField("follower", c.name).Debugf("parked %s until cluster recovers", key)
+	}
+	return true
+}
+
+func (c *cluster) parkedCount() int {
+	c.health.mutex.Lock()
+	defer c.health.mutex.Unlock()
+	count := 0
+	for _, keys := range c.health.parked {
+		count += len(keys)
+	}
+	return count
+}
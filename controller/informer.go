@@ -0,0 +1,444 @@
+package filter
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"soul-mirror/model"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// servedPollInterval 资源类型不可用时检查的间隔
+const servedPollInterval = 5 * time.Second
+
+// informerKey 相同GVR、相同过滤条件的mirror共享一个informer
+type informerKey struct {
+	gvr           schema.GroupVersionResource
+	namespace     string
+	labelSelector string
+	fieldSelector string
+	// 只缓存元数据
+	metadataOnly bool
+}
+
+func (k informerKey) String() string {
+	res := k.gvr.String()
+	if len(k.namespace) > 0 {
+		res += " namespace=" + k.namespace
+	}
+	if len(k.labelSelector) > 0 {
+		res += " labels=" + k.labelSelector
+	}
+	if len(k.fieldSelector) > 0 {
+		res += " fields=" + k.fieldSelector
+	}
+	if k.metadataOnly {
+		res += " metadata-only"
+	}
+	return res
+}
+
+// informerManager 按GVR和过滤条件管理集群中的informer。多个mirror共享同一个informer，
+// 最后一个使用者释放后informer被停止
+type informerManager struct {
+	mutex     sync.Mutex
+	cluster   *cluster
+	resync    time.Duration
+	informers map[informerKey]*sharedInformer
+	// Start 之后新建的informer会立即启动
+	stop <-chan struct{}
+	// list/watch 使用的context，stop 关闭时取消
+	ctx    context.Context
+	cancel context.CancelFunc
+	// 没有权限list/watch的informer
+	forbidden map[informerKey]string
+}
+
+// sharedInformer 引用计数的informer，事件由 dispatch 分发给当前注册的handler，
+// 因此handler可以被移除
+type sharedInformer struct {
+	cache.SharedIndexInformer
+	key     informerKey
+	refs    int
+	stop    chan struct{}
+	started bool
+	// 第一次检查资源类型是否可用后关闭
+	checked chan struct{}
+	// 资源类型在集群中可用后才真正运行
+	running bool
+
+	lock     sync.RWMutex
+	handlers map[*handlerRef]cache.ResourceEventHandler
+}
+
+type handlerRef struct{}
+
+func newInformerManager(c *cluster, resync time.Duration) *informerManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &informerManager{
+		ctx:       ctx,
+		cancel:    cancel,
+		cluster:   c,
+		resync:    resync,
+		informers: make(map[informerKey]*sharedInformer),
+		forbidden: make(map[informerKey]string),
+	}
+}
+
+// acquire 获取对应的informer并增加引用计数，使用完后需要调用 release
+func (im *informerManager) acquire(key informerKey) *sharedInformer {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	si, ok := im.informers[key]
+	if !ok {
+		si = &sharedInformer{
+			SharedIndexInformer: im.newInformer(key),
+			key:                 key,
+			stop:                make(chan struct{}),
+			checked:             make(chan struct{}),
+			handlers:            make(map[*handlerRef]cache.ResourceEventHandler),
+		}
+		si.AddEventHandler(si.dispatch())
+		im.informers[key] = si
+		if im.stop != nil {
+			im.run(si)
+		}
+	}
+	si.refs++
+	return si
+}
+
+// release 减少引用计数，没有使用者时停止informer
+func (im *informerManager) release(key informerKey) {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	si, ok := im.informers[key]
+	if !ok {
+		return
+	}
+	si.refs--
+	if si.refs > 0 {
+		return
+	}
+	close(si.stop)
+	delete(im.informers, key)
+	if _, ok := im.forbidden[key]; ok {
+		delete(im.forbidden, key)
+		InformerForbidden.WithLabelValues(im.cluster.name, key.gvr.String(), key.namespace).Set(0)
+	}
+}
+
+// newInformer 只list/watch符合过滤条件的资源，缓存前去掉资源中不需要的字段
+func (im *informerManager) newInformer(key informerKey) cache.SharedIndexInformer {
+	tweak := func(options *metav1.ListOptions) {
+		options.LabelSelector = key.labelSelector
+		options.FieldSelector = key.fieldSelector
+	}
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	interval := im.cluster.pollInterval
+
+	var client dynamic.ResourceInterface = im.cluster.watchClient.Resource(key.gvr)
+	if len(key.namespace) > 0 {
+		client = im.cluster.watchClient.Resource(key.gvr).Namespace(key.namespace)
+	}
+	list := func(options metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+		tweak(&options)
+		list, err := client.List(im.ctx, options)
+		im.observe(key, err)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			slim(&list.Items[i], key.metadataOnly)
+		}
+		return list, nil
+	}
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return list(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			tweak(&options)
+			w, err := client.Watch(im.ctx, options)
+			if err != nil {
+				im.observe(key, err)
+				return nil, err
+			}
+			return watch.Filter(w, func(event watch.Event) (watch.Event, bool) {
+				if obj, ok := event.Object.(*unstructured.Unstructured); ok {
+					slim(obj, key.metadataOnly)
+				}
+				return event, true
+			}), nil
+		},
+	}
+	if interval > 0 {
+		// 轮询模式，定期list并计算变化
+		p := newPoller(interval)
+		lw.ListFunc = func(options metav1.ListOptions) (runtime.Object, error) {
+			res, err := list(options)
+			if err == nil {
+				p.reset(res)
+			}
+			return res, err
+		}
+		lw.WatchFunc = func(options metav1.ListOptions) (watch.Interface, error) {
+			return p.watch(func() (*unstructured.UnstructuredList, error) {
+				return list(metav1.ListOptions{})
+			}), nil
+		}
+	}
+	return cache.NewSharedIndexInformer(lw, &unstructured.Unstructured{}, im.resync, indexers)
+}
+
+// observe 记录informer是否因为没有权限而无法list/watch
+func (im *informerManager) observe(key informerKey, err error) {
+	if err != nil && !errors.IsForbidden(err) {
+		return
+	}
+	im.mutex.Lock()
+	_, forbidden := im.forbidden[key]
+	if err == nil {
+		delete(im.forbidden, key)
+	} else {
+		im.forbidden[key] = err.Error()
+	}
+	im.mutex.Unlock()
+
+	labels := []string{im.cluster.name, key.gvr.String(), key.namespace}
+	if err == nil {
+		if forbidden {
+			logrus.WithField("cluster", im.cluster.name).Infof("list/watch %s is allowed now", key)
+			InformerForbidden.WithLabelValues(labels...).Set(0)
+		}
+		return
+	}
+	if !forbidden {
+		logrus.WithField("cluster", im.cluster.name).Errorf("forbidden to list/watch %s, check the RBAC of the cluster credentials or restrict the mirror to namespaces: %v", key, err)
+		InformerForbidden.WithLabelValues(labels...).Set(1)
+	}
+}
+
+// Forbidden 返回没有权限list/watch的informer及错误
+func (im *informerManager) Forbidden() map[string]string {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	res := make(map[string]string)
+	for key, err := range im.forbidden {
+		res[key.String()] = err
+	}
+	return res
+}
+
+// slim 减少常驻缓存的内存。managedFields 只保留最后一次写入的时间，用于双向同步的冲突处理；
+// metadataOnly 时只保留资源的元数据。update 会从缓存中的目标资源复制注解，因此只在 metadataOnly 时去掉 last-applied 注解。
+// list/watch 仍会返回并解码完整的资源
+func slim(obj *unstructured.Unstructured, metadataOnly bool) {
+	if len(obj.GetManagedFields()) > 0 {
+		obj.SetManagedFields([]metav1.ManagedFieldsEntry{{Time: &metav1.Time{Time: lastWriteTime(obj)}}})
+	}
+	if !metadataOnly {
+		return
+	}
+	if annotation := obj.GetAnnotations(); len(annotation[corev1.LastAppliedConfigAnnotation]) > 0 {
+		delete(annotation, corev1.LastAppliedConfigAnnotation)
+		obj.SetAnnotations(annotation)
+	}
+	for k := range obj.Object {
+		if k != "apiVersion" && k != "kind" && k != "metadata" {
+			delete(obj.Object, k)
+		}
+	}
+}
+
+// renamed 判断filter是否会修改资源的命名空间或名字
+func renamed(obj model.Mirror) bool {
+	for _, f := range obj.Filter {
+		if strings.HasPrefix(f.Key, "metadata.namespace") || strings.HasPrefix(f.Key, "metadata.name") {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldSelector 将mirror的命名空间和名字条件转换为 fieldSelector，集群级别的资源不使用命名空间条件
+func fieldSelector(config model.MirrorSyncConfig, namespaced bool) string {
+	var selectors []string
+	if len(config.NotInNamespace) > 0 && namespaced {
+		selectors = append(selectors, "metadata.namespace!="+config.NotInNamespace)
+	}
+	if len(config.TargetName) > 0 {
+		selectors = append(selectors, "metadata.name="+config.TargetName)
+	}
+	return strings.Join(selectors, ",")
+}
+
+// Start 启动所有informer
+func (im *informerManager) Start(stop <-chan struct{}) {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	im.stop = stop
+	for _, si := range im.informers {
+		im.run(si)
+	}
+	go func() {
+		<-stop
+		im.cancel()
+	}()
+}
+
+// run 资源类型在集群中可用后启动informer。从集群中的CRD创建并处于 Established 状态之前，
+// 对应的自定义资源无法list，不启动informer，避免一直重试
+func (im *informerManager) run(si *sharedInformer) {
+	if si.started {
+		return
+	}
+	si.started = true
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-im.stop:
+		case <-si.stop:
+		}
+		close(stop)
+	}()
+	gvr, cfg := si.key.gvr, im.cluster.config
+	go func() {
+		ok := served(cfg, gvr)
+		if ok {
+			im.setRunning(si)
+		}
+		close(si.checked)
+		if !ok {
+			logrus.Infof("waiting for %s to be served by cluster %s", gvr.String(), im.cluster.name)
+			if wait.PollUntil(servedPollInterval, func() (bool, error) { return served(cfg, gvr), nil }, stop) != nil {
+				return
+			}
+			im.setRunning(si)
+		}
+		si.Run(stop)
+	}()
+}
+
+func (im *informerManager) setRunning(si *sharedInformer) {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	si.running = true
+}
+
+// served 判断集群是否提供该资源类型
+func served(cfg *rest.Config, gvr schema.GroupVersionResource) bool {
+	client, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return false
+	}
+	list, err := client.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		return false
+	}
+	for _, r := range list.APIResources {
+		if r.Name == gvr.Resource {
+			return true
+		}
+	}
+	return false
+}
+
+// Synced 返回每个informer是否完成了首次同步，等待资源类型可用的informer视为未同步
+func (im *informerManager) Synced() map[string]bool {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	res := make(map[string]bool)
+	for key, si := range im.informers {
+		if si.started {
+			res[key.String()] = si.running && si.HasSynced()
+		}
+	}
+	return res
+}
+
+// WaitForCacheSync 等待所有正在运行的informer完成首次同步，资源类型不可用的informer不等待
+func (im *informerManager) WaitForCacheSync(stop <-chan struct{}) map[string]bool {
+	im.mutex.Lock()
+	var started []*sharedInformer
+	for _, si := range im.informers {
+		if si.started {
+			started = append(started, si)
+		}
+	}
+	im.mutex.Unlock()
+	for _, si := range started {
+		select {
+		case <-si.checked:
+		case <-stop:
+		}
+	}
+
+	im.mutex.Lock()
+	informers := make(map[informerKey]*sharedInformer)
+	for key, si := range im.informers {
+		if si.running {
+			informers[key] = si
+		}
+	}
+	im.mutex.Unlock()
+	res := make(map[string]bool)
+	for key, si := range informers {
+		res[key.String()] = cache.WaitForCacheSync(stop, si.HasSynced)
+	}
+	return res
+}
+
+// addHandler 注册handler，返回移除该handler的函数。informer已同步时会补发已有资源的Add事件
+func (si *sharedInformer) addHandler(handler cache.ResourceEventHandler) func() {
+	ref := &handlerRef{}
+	si.lock.Lock()
+	si.handlers[ref] = handler
+	si.lock.Unlock()
+	if si.HasSynced() {
+		for _, obj := range si.GetIndexer().List() {
+			handler.OnAdd(obj)
+		}
+	}
+	return func() {
+		si.lock.Lock()
+		delete(si.handlers, ref)
+		si.lock.Unlock()
+	}
+}
+
+func (si *sharedInformer) dispatch() cache.ResourceEventHandler {
+	each := func(f func(cache.ResourceEventHandler)) {
+		si.lock.RLock()
+		defer si.lock.RUnlock()
+		for _, h := range si.handlers {
+			f(h)
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			each(func(h cache.ResourceEventHandler) { h.OnAdd(obj) })
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			each(func(h cache.ResourceEventHandler) { h.OnUpdate(oldObj, newObj) })
+		},
+		DeleteFunc: func(obj interface{}) {
+			each(func(h cache.ResourceEventHandler) { h.OnDelete(obj) })
+		},
+	}
+}
@@ -0,0 +1,43 @@
+package filter
+
+import (
+	"soul-mirror/model"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// mirrorPath 返回资源同步到从集群时经过的集群路径。
+// soul-mirror写入后未被修改的资源沿用其来源路径，否则从主集群重新开始。
+// 只根据注解判断，写入资源的可能是其他mirror或重启前的进程
+func (m *mirrorController) mirrorPath(obj *unstructured.Unstructured) []string {
+	main := m.config.Config.Clusters.Main
+	if !m.unmodified(obj) {
+		return []string{main}
+	}
+	var path []string
+	for _, cluster := range strings.Split(obj.GetAnnotations()[model.MirrorPathAnnotation], ",") {
+		if len(cluster) > 0 {
+			path = append(path, cluster)
+		}
+	}
+	return append(path, main)
+}
+
+// looped 判断同步到从集群是否会让资源回到它经过的集群。主集群同步到自身的情况由配置保证，不在此处理
+func (m *mirrorController) looped(path []string, follower string) bool {
+	if follower == m.config.Config.Clusters.Main {
+		return false
+	}
+	for _, cluster := range path {
+		if cluster == follower {
+			return true
+		}
+	}
+	return false
+}
+
+func setPath(annotation map[string]string, path []string) {
+	annotation[model.OriginClusterAnnotation] = path[0]
+	annotation[model.MirrorPathAnnotation] = strings.Join(path, ",")
+}
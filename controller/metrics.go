@@ -10,17 +10,37 @@ var (
 		Name:    "event_handle_duration_milliseconds",
 		Help:    "The latency of event handle",
 		Buckets: []float64{0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1, 2, 5, 10, 100, 500, 1000, 5000},
-	}, []string{"name", "event_type"})
+	}, []string{"name", "event_type", "follower"})
 	EventHandleCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "event_handle_count",
 		Help: "The count of event handle",
-	}, []string{"name", "event_type"})
+	}, []string{"name", "event_type", "follower"})
 	EventHandleErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "event_handle_error_count",
 		Help: "The count of event handle error",
-	}, []string{"name", "event_type", "error_type"})
+	}, []string{"name", "event_type", "error_type", "follower"})
 	EventHandleRetryCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "event_handle_retry_count",
 		Help: "The count of event handle retry",
-	}, []string{"name"})
+	}, []string{"name", "follower"})
+	ReconcileObjectCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reconcile_object_count",
+		Help: "The count of objects checked, found out of sync and repaired by periodic reconcile",
+	}, []string{"name", "result"})
+	ClusterState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cluster_state",
+		Help: "The health state of cluster, 1 for the current state",
+	}, []string{"cluster", "state"})
+	DeadLetterCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dead_letter_count",
+		Help: "The count of objects given up after max retries",
+	}, []string{"name", "follower"})
+	InformerForbidden = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "informer_forbidden",
+		Help: "Whether the informer is forbidden to list or watch the resource",
+	}, []string{"cluster", "resource", "namespace"})
+	ParkedObjectCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "parked_object_count",
+		Help: "The count of objects waiting for an unreachable cluster to recover",
+	}, []string{"cluster"})
 )
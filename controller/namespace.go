@@ -0,0 +1,222 @@
+package filter
+
+import (
+	"soul-mirror/model"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+var namespaceGVR = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+
+// namespaceMissing 判断创建资源失败是否因为从集群中没有对应的命名空间
+func namespaceMissing(err error) bool {
+	if !errors.IsNotFound(err) {
+		return false
+	}
+	status, ok := err.(errors.APIStatus)
+	return ok && status.Status().Details != nil && status.Status().Details.Kind == "namespaces"
+}
+
+// ensureNamespace 在从集群中创建命名空间，并标记为由soul-mirror管理
+func (m *mirrorController) ensureNamespace(cluster *cluster, namespace string) error {
+	cfg := m.config.Config.CreateNamespace
+	ns := &unstructured.Unstructured{}
+	ns.SetAPIVersion("v1")
+	ns.SetKind("Namespace")
+	ns.SetName(namespace)
+	nsLabels := map[string]string{model.ManagedNamespaceAnnotation: "true"}
+	for k, v := range cfg.Labels {
+		nsLabels[k] = v
+	}
+	ns.SetLabels(nsLabels)
+	annotation := make(map[string]string)
+	for k, v := range cfg.Annotations {
+		annotation[k] = v
+	}
+	annotation[model.ManagedNamespaceAnnotation] = m.config.Name
+	ns.SetAnnotations(annotation)
+
+	cluster.throttle()
+	_, err := cluster.client.Resource(namespaceGVR).Create(m.ctx, ns, metav1.CreateOptions{})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		m.logger.WithField("to", cluster.name).WithError(err).Errorf("failed to create namespace %s", namespace)
+		return err
+	}
+	m.logger.WithField("to", cluster.name).Infof("created namespace %s", namespace)
+	EventHandleCount.WithLabelValues(m.config.Name, "namespace_created", cluster.name).Inc()
+	return nil
+}
+
+// collectNamespace 删除由soul-mirror创建、且不再有任何被同步资源的命名空间
+func (m *mirrorController) collectNamespace(cluster *cluster, namespace string) {
+	cfg := m.config.Config.CreateNamespace
+	if !cfg.Enabled || !cfg.GarbageCollect || len(namespace) == 0 || m.dryRun() {
+		return
+	}
+	ns, err := cluster.client.Resource(namespaceGVR).Get(m.ctx, namespace, metav1.GetOptions{})
+	if err != nil || ns.GetDeletionTimestamp() != nil {
+		return
+	}
+	if _, ok := ns.GetAnnotations()[model.ManagedNamespaceAnnotation]; !ok {
+		return
+	}
+	if mirrored(cluster, namespace) {
+		return
+	}
+	// 命名空间中可能还有其他人创建的资源，删除命名空间会级联删除它们
+	if empty, err := m.namespaceEmpty(cluster, namespace); err != nil || !empty {
+		if err != nil {
+			m.logger.WithField("to", cluster.name).WithError(err).Warnf("failed to check whether namespace %s is empty", namespace)
+		}
+		return
+	}
+	cluster.throttle()
+	err = cluster.client.Resource(namespaceGVR).Delete(m.ctx, namespace, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		m.logger.WithField("to", cluster.name).WithError(err).Warnf("failed to delete namespace %s", namespace)
+		return
+	}
+	m.logger.WithField("to", cluster.name).Infof("deleted empty namespace %s", namespace)
+	EventHandleCount.WithLabelValues(m.config.Name, "namespace_deleted", cluster.name).Inc()
+}
+
+// mirrored 判断从集群的命名空间中是否还有被同步的资源类型的对象，或者主集群中是否还有需要同步到该命名空间的资源。
+// 由其他副本负责的mirror无法读取缓存，可能同步到该命名空间时视为仍在使用
+func mirrored(cluster *cluster, namespace string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, c := range clusterMap {
+		for _, obj := range c.desired {
+			if c.running(obj) || !follows(obj, cluster.name) {
+				continue
+			}
+			if ns := namespaces(obj.Config); len(ns) == 0 || inNamespaces(ns, namespace) || renamed(obj) {
+				return true
+			}
+		}
+		for _, m := range c.mirrors {
+			if !m.hasFollower(cluster.name) {
+				continue
+			}
+			if lister := m.getTargetLister(cluster); lister != nil {
+				if objects, err := lister.Namespace(namespace).List(labels.Everything()); err != nil || len(objects) > 0 {
+					return true
+				}
+			}
+			for _, o := range m.indexer.List() {
+				obj, ok := o.(*unstructured.Unstructured)
+				if ok && obj.GetNamespace() == namespace && m.match(obj) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// namespaceEmpty 通过discovery列出命名空间中所有可以list的资源，除集群自动创建的对象外没有任何对象时才认为命名空间为空
+func (m *mirrorController) namespaceEmpty(cluster *cluster, namespace string) (bool, error) {
+	mutex.Lock()
+	cfg := rest.CopyConfig(cluster.config)
+	mutex.Unlock()
+	client, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return false, err
+	}
+	// 部分API不可用时无法确认，不删除
+	lists, err := client.ServerPreferredNamespacedResources()
+	if err != nil {
+		return false, err
+	}
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			return false, err
+		}
+		for _, r := range list.APIResources {
+			if strings.Contains(r.Name, "/") || r.Name == "events" || !hasVerb(r, "list") {
+				continue
+			}
+			objects, err := cluster.client.Resource(gv.WithResource(r.Name)).Namespace(namespace).List(m.ctx, metav1.ListOptions{Limit: 10})
+			if errors.IsNotFound(err) || errors.IsMethodNotSupported(err) {
+				continue
+			} else if err != nil {
+				return false, err
+			}
+			if len(objects.GetContinue()) > 0 {
+				return false, nil
+			}
+			for i := range objects.Items {
+				if !generated(gv.Group, r.Name, &objects.Items[i]) {
+					m.logger.WithField("to", cluster.name).Debugf("namespace %s still contains %s %s", namespace, r.Name, objects.Items[i].GetName())
+					return false, nil
+				}
+			}
+		}
+	}
+	return true, nil
+}
+
+func hasVerb(r metav1.APIResource, verb string) bool {
+	for _, v := range r.Verbs {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
+
+// generated 判断对象是否为集群在每个命名空间中自动创建的
+func generated(group, resource string, obj *unstructured.Unstructured) bool {
+	if len(group) > 0 {
+		return false
+	}
+	switch resource {
+	case "configmaps":
+		return obj.GetName() == "kube-root-ca.crt"
+	case "serviceaccounts":
+		return obj.GetName() == "default"
+	case "secrets":
+		secretType, _, _ := unstructured.NestedString(obj.Object, "type")
+		return secretType == "kubernetes.io/service-account-token" && obj.GetAnnotations()["kubernetes.io/service-account.name"] == "default"
+	}
+	return false
+}
+
+// collectNamespaces 检查从集群中所有由soul-mirror创建的命名空间
+func (m *mirrorController) collectNamespaces() {
+	cfg := m.config.Config.CreateNamespace
+	if !cfg.Enabled || !cfg.GarbageCollect {
+		return
+	}
+	for _, clusterName := range m.config.Config.Clusters.Follower {
+		cluster, ok := clusterMap[clusterName]
+		if !ok {
+			continue
+		}
+		list, err := cluster.client.Resource(namespaceGVR).List(m.ctx, metav1.ListOptions{LabelSelector: model.ManagedNamespaceAnnotation + "=true"})
+		if err != nil {
+			m.logger.WithField("to", clusterName).WithError(err).Warn("failed to list managed namespaces")
+			continue
+		}
+		for _, ns := range list.Items {
+			m.collectNamespace(cluster, ns.GetName())
+		}
+	}
+}
+
+func (m *mirrorController) hasFollower(name string) bool {
+	for _, follower := range m.config.Config.Clusters.Follower {
+		if follower == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"soul-mirror/model"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic/dynamiclister"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// objectStore 主集群资源的缓存
+type objectStore interface {
+	GetByKey(key string) (interface{}, bool, error)
+	List() []interface{}
+}
+
+// namespaces 返回mirror限定的命名空间，为空时同步所有命名空间
+func namespaces(config model.MirrorSyncConfig) []string {
+	set := make(map[string]struct{})
+	for _, ns := range config.Namespaces {
+		set[ns] = struct{}{}
+	}
+	if len(config.Namespace) > 0 {
+		set[config.Namespace] = struct{}{}
+	}
+	res := make([]string, 0, len(set))
+	for ns := range set {
+		res = append(res, ns)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// namespacedStore 合并每个命名空间一个的informer缓存
+type namespacedStore map[string]cache.Indexer
+
+func (s namespacedStore) GetByKey(key string) (interface{}, bool, error) {
+	ns, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	indexer, ok := s[ns]
+	if !ok {
+		return nil, false, nil
+	}
+	return indexer.GetByKey(key)
+}
+
+func (s namespacedStore) List() []interface{} {
+	var res []interface{}
+	for _, indexer := range s {
+		res = append(res, indexer.List()...)
+	}
+	return res
+}
+
+// namespacedLister 合并每个命名空间一个的从集群缓存
+type namespacedLister struct {
+	gvr     schema.GroupVersionResource
+	listers map[string]dynamiclister.Lister
+}
+
+func newNamespacedLister(gvr schema.GroupVersionResource, indexers map[string]cache.Indexer) dynamiclister.Lister {
+	if indexer, ok := indexers[""]; ok && len(indexers) == 1 {
+		return dynamiclister.New(indexer, gvr)
+	}
+	l := &namespacedLister{gvr: gvr, listers: make(map[string]dynamiclister.Lister)}
+	for ns, indexer := range indexers {
+		l.listers[ns] = dynamiclister.New(indexer, gvr)
+	}
+	return l
+}
+
+func (l *namespacedLister) List(selector labels.Selector) ([]*unstructured.Unstructured, error) {
+	var res []*unstructured.Unstructured
+	for _, lister := range l.listers {
+		objects, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, objects...)
+	}
+	return res, nil
+}
+
+func (l *namespacedLister) Get(name string) (*unstructured.Unstructured, error) {
+	ns, _, err := cache.SplitMetaNamespaceKey(name)
+	if err != nil {
+		return nil, err
+	}
+	lister, ok := l.listers[ns]
+	if !ok {
+		return nil, errors.NewNotFound(l.gvr.GroupResource(), name)
+	}
+	return lister.Get(name)
+}
+
+func (l *namespacedLister) Namespace(namespace string) dynamiclister.NamespaceLister {
+	if lister, ok := l.listers[namespace]; ok {
+		return lister.Namespace(namespace)
+	}
+	return dynamiclister.New(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}), l.gvr).Namespace(namespace)
+}
+
+func inNamespaces(namespaces []string, namespace string) bool {
+	for _, ns := range namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaced 通过集群的discovery判断资源类型是否属于命名空间，无法判断时按命名空间资源处理
+func (c *cluster) namespaced(gvr schema.GroupVersionResource) bool {
+	if namespaced, ok := c.scopes[gvr]; ok {
+		return namespaced
+	}
+	cfg := rest.CopyConfig(c.config)
+	cfg.Timeout = probeTimeout
+	client, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err == nil {
+		var list *metav1.APIResourceList
+		if list, err = client.ServerResourcesForGroupVersion(gvr.GroupVersion().String()); err == nil {
+			for _, r := range list.APIResources {
+				if r.Name == gvr.Resource {
+					c.scopes[gvr] = r.Namespaced
+					return r.Namespaced
+				}
+			}
+			err = fmt.Errorf("resource %s not found", gvr.Resource)
+		}
+	}
+	logrus.WithField("cluster", c.name).Warnf("unable to determine the scope of %s, assuming namespaced: %v", gvr.String(), err)
+	return true
+}
@@ -0,0 +1,111 @@
+package filter
+
+import (
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+// WaitForCacheSync 启动所有informer并等待缓存同步，但不启动worker，用于只执行一次的命令
+func WaitForCacheSync(stop chan struct{}) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var synced []cache.InformerSynced
+	for _, c := range clusterMap {
+		c.caches.Start(stop)
+		c.informers.Start(stop)
+		for _, m := range c.mirrors {
+			synced = append(synced, m.hasSynced)
+		}
+	}
+	for _, c := range clusterMap {
+		for _, ok := range c.caches.WaitForCacheSync(stop) {
+			if !ok {
+				return false
+			}
+		}
+	}
+	return cache.WaitForCacheSync(stop, synced...)
+}
+
+// SyncOnce 将所有mirror中符合条件的资源同步一次，返回同步失败的资源数
+func SyncOnce(progress func(mirror string, done, total int)) int {
+	mutex.Lock()
+	var mirrors []*mirrorController
+	for _, c := range clusterMap {
+		for _, m := range c.mirrors {
+			mirrors = append(mirrors, m)
+		}
+	}
+	mutex.Unlock()
+	// 命名空间和CRD先于依赖它们的资源同步
+	sort.Slice(mirrors, func(i, j int) bool {
+		if rank(mirrors[i]) != rank(mirrors[j]) {
+			return rank(mirrors[i]) < rank(mirrors[j])
+		}
+		return mirrors[i].String() < mirrors[j].String()
+	})
+
+	failed := 0
+	for _, m := range mirrors {
+		var keys []string
+		for _, o := range m.indexer.List() {
+			obj, ok := o.(*unstructured.Unstructured)
+			if !ok || !m.match(obj) {
+				continue
+			}
+			if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for i, key := range keys {
+			if err := m.sync(key); err != nil {
+				failed++
+			}
+			if progress != nil {
+				progress(m.config.Name+" "+m.gvr.Resource, i+1, len(keys))
+			}
+		}
+	}
+	return failed + drainHeld(mirrors, time.Minute)
+}
+
+func rank(m *mirrorController) int {
+	switch {
+	case isNamespaceMirror(m):
+		return 0
+	case isCRDMirror(m):
+		return 1
+	case m.refs != nil:
+		// 被引用的资源在同步工作负载时才确定
+		return 3
+	}
+	return 2
+}
+
+// drainHeld 等待暂存的资源的依赖就绪并同步这些资源，返回超时后仍未同步的资源数
+func drainHeld(mirrors []*mirrorController, timeout time.Duration) int {
+	if heldCount() == 0 {
+		return 0
+	}
+	failed := 0
+	deadline := time.Now().Add(timeout)
+	for heldCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+	for _, m := range mirrors {
+		for follower, queue := range m.followerQueues {
+			for queue.Len() > 0 {
+				key, _ := queue.Get()
+				if _, err := m.syncFollower(follower, key.(string)); err != nil {
+					failed++
+				}
+				queue.Done(key)
+			}
+		}
+	}
+	return failed + heldCount()
+}
@@ -0,0 +1,168 @@
+package filter
+
+import (
+	"encoding/json"
+	"soul-mirror/model"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// revision 描述双向同步中资源的来源集群与逻辑版本
+type revision struct {
+	origin    string
+	version   int64
+	timestamp time.Time
+	// 资源在所在集群中被修改过，需要同步给其他集群
+	modified bool
+}
+
+func (m *mirrorController) bidirectional() bool {
+	return m.config.Config.Mode == model.MirrorModeBidirectional
+}
+
+// revisionOf 读取资源上的来源注解。如果资源不是soul-mirror写入后未被修改的副本，
+// 则视为在该集群中发生了修改，逻辑版本加一
+func (m *mirrorController) revisionOf(clusterName string, obj *unstructured.Unstructured) revision {
+	annotation := obj.GetAnnotations()
+	rev := revision{origin: annotation[model.OriginClusterAnnotation]}
+	rev.version, _ = strconv.ParseInt(annotation[model.LogicalVersionAnnotation], 10, 64)
+	rev.timestamp, _ = time.Parse(time.RFC3339Nano, annotation[model.OriginTimestampAnnotation])
+	if m.replica(clusterName, obj) {
+		return rev
+	}
+	return revision{
+		origin:    clusterName,
+		version:   rev.version + 1,
+		timestamp: lastWriteTime(obj),
+		modified:  true,
+	}
+}
+
+// replica 判断资源是否为soul-mirror写入后未被修改的副本，用于抑制回声
+func (m *mirrorController) replica(clusterName string, obj *unstructured.Unstructured) bool {
+	if c, ok := clusterMap[clusterName]; ok {
+		v, ok := c.written.Load(m.writtenKey(obj))
+		if ok && v.(writtenVersion).resourceVersion == obj.GetResourceVersion() {
+			return true
+		}
+	}
+	return m.unmodified(obj)
+}
+
+// unmodified 根据资源上持久化的注解判断资源写入后是否被修改过，不依赖进程内的状态
+func (m *mirrorController) unmodified(obj *unstructured.Unstructured) bool {
+	annotation := obj.GetAnnotations()
+	if len(annotation[model.OriginClusterAnnotation]) == 0 {
+		return false
+	}
+	b, _ := json.Marshal(obj)
+	if hash, ok := annotation[model.WrittenHashAnnotation]; ok {
+		return writtenHash(b) == hash
+	}
+	// 旧版本写入的资源只有按mirror配置计算的摘要
+	hash, ok := annotation[model.ContentHashAnnotation]
+	return ok && contentHash(m.normalize(b)) == hash
+}
+
+// resolve 判断是否用来源资源覆盖目标集群中的资源
+func (m *mirrorController) resolve(follower string, src revision, srcObject, targetObject *unstructured.Unstructured) bool {
+	dst := m.revisionOf(follower, targetObject)
+	if src.version != dst.version {
+		return src.version > dst.version
+	}
+	if src.origin == dst.origin {
+		return true
+	}
+
+	// 两个集群并发修改了同一个资源
+	EventHandleCount.WithLabelValues(m.config.Name, "origin_conflict", follower).Inc()
+	logger := m.logger.WithField("to", follower).WithField("origin", src.origin).WithField("target", dst.origin)
+	switch m.config.Config.ConflictStrategy {
+	case model.ConflictStrategyManual:
+		_, srcWin := srcObject.GetAnnotations()[model.ConflictWinnerAnnotation]
+		_, dstWin := targetObject.GetAnnotations()[model.ConflictWinnerAnnotation]
+		if srcWin && !dstWin {
+			return true
+		}
+		if !srcWin {
+			logger.Warnf("conflict on %s needs manual resolution", m.fmtMeta(srcObject))
+		}
+		return false
+	case model.ConflictStrategyPriority:
+		return m.priority(src.origin) < m.priority(dst.origin)
+	default:
+		if !src.timestamp.Equal(dst.timestamp) {
+			return src.timestamp.After(dst.timestamp)
+		}
+		return m.priority(src.origin) < m.priority(dst.origin)
+	}
+}
+
+// priority 返回集群在 peers 中的顺序，越靠前优先级越高
+func (m *mirrorController) priority(cluster string) int {
+	for i, peer := range m.config.Config.Clusters.Peers {
+		if peer == cluster {
+			return i
+		}
+	}
+	return len(m.config.Config.Clusters.Peers)
+}
+
+// writtenTTL 写入记录只用于抑制紧随其后的回声，过期后按注解判断
+const writtenTTL = 10 * time.Minute
+
+type writtenVersion struct {
+	resourceVersion string
+	time            time.Time
+}
+
+func (m *mirrorController) writtenKey(obj *unstructured.Unstructured) string {
+	return m.gvr.String() + "/" + m.fmtMeta(obj)
+}
+
+// recordWrite 记录soul-mirror写入后的 resourceVersion，对应的事件不会再被同步回来源集群
+func (m *mirrorController) recordWrite(cluster *cluster, obj *unstructured.Unstructured) {
+	if obj != nil {
+		cluster.written.Store(m.writtenKey(obj), writtenVersion{resourceVersion: obj.GetResourceVersion(), time: time.Now()})
+	}
+}
+
+// forgetWrite 资源被删除后移除写入记录
+func (m *mirrorController) forgetWrite(cluster *cluster, key string) {
+	cluster.written.Delete(m.gvr.String() + "/" + key)
+}
+
+// pruneWritten 移除过期的写入记录
+func (c *cluster) pruneWritten() {
+	c.written.Range(func(key, v interface{}) bool {
+		if time.Since(v.(writtenVersion).time) > writtenTTL {
+			c.written.Delete(key)
+		}
+		return true
+	})
+}
+
+func sameRevision(rev revision, obj *unstructured.Unstructured) bool {
+	annotation := obj.GetAnnotations()
+	return annotation[model.OriginClusterAnnotation] == rev.origin &&
+		annotation[model.LogicalVersionAnnotation] == strconv.FormatInt(rev.version, 10)
+}
+
+func setRevision(annotation map[string]string, rev revision) {
+	annotation[model.OriginClusterAnnotation] = rev.origin
+	annotation[model.LogicalVersionAnnotation] = strconv.FormatInt(rev.version, 10)
+	annotation[model.OriginTimestampAnnotation] = rev.timestamp.UTC().Format(time.RFC3339Nano)
+}
+
+// lastWriteTime 返回资源最后一次被写入的时间
+func lastWriteTime(obj *unstructured.Unstructured) time.Time {
+	t := obj.GetCreationTimestamp().Time
+	for _, field := range obj.GetManagedFields() {
+		if field.Time != nil && field.Time.After(t) {
+			t = field.Time.Time
+		}
+	}
+	return t
+}
@@ -0,0 +1,124 @@
+package filter
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// poller 轮询模式下记录informer中已有的资源，用于计算两次list之间的变化
+type poller struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	known    map[string]*unstructured.Unstructured
+}
+
+func newPoller(interval time.Duration) *poller {
+	return &poller{interval: interval, known: make(map[string]*unstructured.Unstructured)}
+}
+
+// reset 以informer的list结果作为之后比较的基准
+func (p *poller) reset(list *unstructured.UnstructuredList) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.known = make(map[string]*unstructured.Unstructured, len(list.Items))
+	for i := range list.Items {
+		if key, err := cache.MetaNamespaceKeyFunc(&list.Items[i]); err == nil {
+			p.known[key] = &list.Items[i]
+		}
+	}
+}
+
+// diff 比较新的list结果，返回新增、修改和删除事件
+func (p *poller) diff(list *unstructured.UnstructuredList) []watch.Event {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var events []watch.Event
+	seen := make(map[string]struct{}, len(list.Items))
+	for i := range list.Items {
+		obj := &list.Items[i]
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			continue
+		}
+		seen[key] = struct{}{}
+		old, ok := p.known[key]
+		switch {
+		case !ok:
+			events = append(events, watch.Event{Type: watch.Added, Object: obj})
+		case old.GetResourceVersion() != obj.GetResourceVersion():
+			events = append(events, watch.Event{Type: watch.Modified, Object: obj})
+		}
+	}
+	for key, obj := range p.known {
+		if _, ok := seen[key]; !ok {
+			events = append(events, watch.Event{Type: watch.Deleted, Object: obj})
+		}
+	}
+	return events
+}
+
+// apply 事件送达informer后更新基准
+func (p *poller) apply(event watch.Event) {
+	obj := event.Object.(*unstructured.Unstructured)
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if event.Type == watch.Deleted {
+		delete(p.known, key)
+	} else {
+		p.known[key] = obj
+	}
+}
+
+// pollWatcher 定期list资源并生成watch事件，用于没有watch权限的集群
+type pollWatcher struct {
+	result chan watch.Event
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func (p *poller) watch(list func() (*unstructured.UnstructuredList, error)) watch.Interface {
+	w := &pollWatcher{result: make(chan watch.Event), stop: make(chan struct{})}
+	go func() {
+		defer close(w.result)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+			}
+			res, err := list()
+			if err != nil {
+				continue
+			}
+			for _, event := range p.diff(res) {
+				select {
+				case w.result <- event:
+					p.apply(event)
+				case <-w.stop:
+					return
+				}
+			}
+		}
+	}()
+	return w
+}
+
+func (w *pollWatcher) Stop() {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+}
+
+func (w *pollWatcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
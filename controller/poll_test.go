@@ -0,0 +1,80 @@
+package filter
+
+import (
+	"sort"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func configMap(name, resourceVersion string) unstructured.Unstructured {
+	obj := unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetResourceVersion(resourceVersion)
+	return obj
+}
+
+func TestPollerDiff(t *testing.T) {
+	tests := []struct {
+		name  string
+		known []unstructured.Unstructured
+		list  []unstructured.Unstructured
+		want  []string
+	}{
+		{
+			name:  "unchanged",
+			known: []unstructured.Unstructured{configMap("a", "1")},
+			list:  []unstructured.Unstructured{configMap("a", "1")},
+		},
+		{
+			name: "added",
+			list: []unstructured.Unstructured{configMap("a", "1")},
+			want: []string{"ADDED default/a"},
+		},
+		{
+			name:  "modified",
+			known: []unstructured.Unstructured{configMap("a", "1")},
+			list:  []unstructured.Unstructured{configMap("a", "2")},
+			want:  []string{"MODIFIED default/a"},
+		},
+		{
+			name:  "deleted",
+			known: []unstructured.Unstructured{configMap("a", "1")},
+			want:  []string{"DELETED default/a"},
+		},
+		{
+			name:  "mixed",
+			known: []unstructured.Unstructured{configMap("a", "1"), configMap("b", "1"), configMap("c", "1")},
+			list:  []unstructured.Unstructured{configMap("a", "1"), configMap("b", "2"), configMap("d", "1")},
+			want:  []string{"ADDED default/d", "DELETED default/c", "MODIFIED default/b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPoller(0)
+			p.reset(&unstructured.UnstructuredList{Items: tt.known})
+			var got []string
+			for _, event := range p.diff(&unstructured.UnstructuredList{Items: tt.list}) {
+				obj := event.Object.(*unstructured.Unstructured)
+				got = append(got, string(event.Type)+" "+obj.GetNamespace()+"/"+obj.GetName())
+				p.apply(event)
+			}
+			sort.Strings(got)
+			if len(got) != len(tt.want) {
+				t.Fatalf("diff() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("diff() = %v, want %v", got, tt.want)
+				}
+			}
+			// 应用事件后再次比较没有变化
+			if events := p.diff(&unstructured.UnstructuredList{Items: tt.list}); len(events) > 0 {
+				t.Errorf("diff() after apply = %v, want no events", events)
+			}
+		})
+	}
+}
@@ -3,14 +3,19 @@ package filter
 import (
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
 	"time"
 
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
+// processNextItem 将主集群中变化的资源分发到每个从集群的队列
 func (m *mirrorController) processNextItem() bool {
 	// Wait until there is a new item in the working queue
 	key, quit := m.queue.Get()
@@ -19,84 +24,196 @@ func (m *mirrorController) processNextItem() bool {
 	}
 	defer m.queue.Done(key)
 
-	err := m.sync(key.(string))
-	m.handleErr(err, key)
+	for _, queue := range m.followerQueues {
+		queue.Add(key)
+	}
+	m.queue.Forget(key)
+	return true
+}
+
+// processNextFollowerItem 同步资源到一个从集群，每个从集群独立重试，互不阻塞
+func (m *mirrorController) processNextFollowerItem(follower string, queue workqueue.RateLimitingInterface) bool {
+	key, quit := queue.Get()
+	if quit {
+		return false
+	}
+	defer queue.Done(key)
+	atomic.AddInt32(&m.inflight, 1)
+	defer atomic.AddInt32(&m.inflight, -1)
+	// 停止后不再处理队列中剩余的key
+	select {
+	case <-m.stop:
+		return false
+	default:
+	}
+
+	// 死信中的资源只有在主集群中变化后才重新同步，避免每次更新事件都重试
+	if m.skipDeadLetter(follower, key.(string)) {
+		queue.Forget(key)
+		return true
+	}
+	wrote, err := m.syncFollower(follower, key.(string))
+	m.handleErr(follower, queue, err, key)
+	if err == nil {
+		m.forgetDeadLetter(follower, key.(string))
+		// 只有实际写入从集群才计入修复数
+		if _, ok := m.repairing.LoadAndDelete(follower + "/" + key.(string)); ok && wrote {
+			ReconcileObjectCount.WithLabelValues(m.config.Name, "repaired").Inc()
+		}
+	}
 	return true
 }
 
+// sync 将资源依次同步到所有从集群，用于只执行一次的命令
 func (m *mirrorController) sync(key string) error {
+	var errs []error
+	for _, follower := range m.config.Config.Clusters.Follower {
+		if _, err := m.syncFollower(follower, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// syncFollower 同步资源到一个从集群，返回是否实际写入了从集群
+func (m *mirrorController) syncFollower(clusterName, key string) (bool, error) {
+	cluster, ok := clusterMap[clusterName]
+	if !ok {
+		return false, nil
+	}
+	logger := m.logger.WithField("follower", clusterName)
 	o, exists, err := m.indexer.GetByKey(key)
 	if err != nil {
-		m.logger.Errorf("Fetching object with key %s from store failed with %v", key, err)
-		return err
+		logger.Errorf("Fetching object with key %s from store failed with %v", key, err)
+		return false, err
 	}
 	startTime := time.Now()
 
+	if m.park(cluster, key) {
+		return false, nil
+	}
+
 	// 删除事件
 	if !exists {
-		m.logger.Debugf("deleting %s %s", m.config.Name, key)
-		defer EventHandleDuration.WithLabelValues(m.config.Name, "delete").Observe(float64(time.Since(startTime).Milliseconds()))
-		for _, clusterName := range m.config.Config.Clusters.Follower {
-			cluster, ok := clusterMap[clusterName]
-			if !ok {
-				continue
-			}
-			err = m.delete(cluster, key)
-			if err == nil {
-				m.logger.WithField("follower", clusterName).Debugf("deleted %s %s", m.config.Name, key)
-			} else {
-				return err
+		// 未开启同步删除时，队列中不存在于主集群的资源（例如隐式mirror引用但尚未创建的资源）不能删除从集群中的同名资源
+		if !m.config.Config.SyncDelete {
+			return false, nil
+		}
+		if left, err := m.leftSelector(key); err != nil || left {
+			if left {
+				logger.Debugf("skip deleting %s: no longer matches the selector", key)
 			}
+			return false, err
 		}
-		return err
+		logger.Debugf("deleting %s %s", m.config.Name, key)
+		defer func() {
+			EventHandleDuration.WithLabelValues(m.config.Name, "delete", clusterName).Observe(float64(time.Since(startTime).Microseconds()) / 1000)
+		}()
+		wrote, err := m.delete(cluster, key)
+		m.record(clusterName, err)
+		if err == nil {
+			logger.Debugf("deleted %s %s", m.config.Name, key)
+		}
+		return wrote, err
 	}
 
 	// 更新事件
 	obj := o.(*unstructured.Unstructured)
-	m.logger.Debugf("updating %s", key)
-	defer EventHandleDuration.WithLabelValues(m.config.Name, "update").Observe(float64(time.Since(startTime).Microseconds()) / 1000)
-	src, _ := json.Marshal(obj)
-	for _, clusterName := range m.config.Config.Clusters.Follower {
-		cluster, ok := clusterMap[clusterName]
-		if !ok {
-			continue
-		}
-		err = m.update(cluster, src, obj)
-		if err == nil {
-			m.logger.WithField("follower", clusterName).Debugf("updated %s", key)
-		} else {
-			return err
+	logger.Debugf("updating %s", key)
+	defer func() {
+		EventHandleDuration.WithLabelValues(m.config.Name, "update", clusterName).Observe(float64(time.Since(startTime).Microseconds()) / 1000)
+	}()
+	if m.bidirectional() && !m.revisionOf(m.config.Config.Clusters.Main, obj).modified {
+		logger.Debugf("skip replica %s", key)
+		return false, nil
+	}
+	if !m.bidirectional() && m.looped(m.mirrorPath(obj), clusterName) {
+		logger.Debugf("skip %s: already mirrored from %v", key, m.mirrorPath(obj))
+		EventHandleCount.WithLabelValues(m.config.Name, "loop_suppressed", clusterName).Inc()
+		return false, nil
+	}
+	m.enqueueReferences(obj)
+	if dep := m.unmetDependency(cluster, obj); dep != "" {
+		m.hold(cluster, dep, key)
+		// 暂存期间依赖可能已经就绪
+		if m.unmetDependency(cluster, obj) == "" {
+			release(clusterName, dep)
 		}
+		return false, nil
 	}
-	return nil
+
+	src, _ := json.Marshal(obj)
+	wrote, err := m.update(cluster, src, obj)
+	m.record(clusterName, err)
+	hash := contentHash(m.normalize(m.filter(src, []byte{})))
+	m.writeStatus(obj, map[string]objectStatus{clusterName: newObjectStatus(obj, hash, err)})
+	if err != nil && !errors.IsConflict(err) {
+		m.eventFailed(clusterName, obj, err)
+	}
+	if err == nil {
+		logger.Debugf("updated %s", key)
+	}
+	return wrote, err
 }
 
-func (m *mirrorController) handleErr(err error, key interface{}) {
+func (m *mirrorController) handleErr(follower string, queue workqueue.RateLimitingInterface, err error, key interface{}) {
 	if err == nil {
-		m.queue.Forget(key)
+		queue.Forget(key)
 		return
 	}
 
-	m.logger.Infof("Error syncing %v: %v", key, err)
-	m.queue.AddRateLimited(key)
-	EventHandleRetryCount.WithLabelValues(m.config.Name).Inc()
+	// 集群熔断期间不再重试
+	if c, ok := clusterMap[follower]; ok && m.park(c, key.(string)) {
+		queue.Forget(key)
+		return
+	}
+	if max := m.config.Config.MaxRetries; max > 0 && queue.NumRequeues(key) >= max {
+		m.deadLetter(follower, key.(string), queue.NumRequeues(key)+1, err)
+		queue.Forget(key)
+		return
+	}
+	m.logger.WithField("follower", follower).Infof("Error syncing %v: %v", key, err)
+	queue.AddRateLimited(key)
+	EventHandleRetryCount.WithLabelValues(m.config.Name, follower).Inc()
 	return
 }
 
 // Run begins watching and syncing.
-func (m *mirrorController) Run(workers int, stopCh chan struct{}) {
+func (m *mirrorController) Run(workers int, stopCh <-chan struct{}) {
 	defer runtime.HandleCrash()
-	defer m.queue.ShutDown()
+	defer m.close()
 
-	go m.informer.Run(stopCh)
+	// mirror被删除或服务退出时停止
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-stopCh:
+		case <-m.stop:
+		}
+		close(stop)
+	}()
+	stopCh = stop
 
-	if !cache.WaitForCacheSync(stopCh, m.informer.HasSynced) {
+	if !cache.WaitForCacheSync(stopCh, m.hasSynced) {
 		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
 		return
 	}
 
-	for i := 0; i < workers; i++ {
-		go wait.Until(m.runWorker, time.Second, stopCh)
+	go wait.Until(m.runWorker, time.Second, stopCh)
+	for follower, queue := range m.followerQueues {
+		follower, queue := follower, queue
+		// 每个从集群单独等待缓存同步，从集群中CRD还未创建或没有权限时只影响该从集群
+		go func() {
+			if !cache.WaitForCacheSync(stopCh, m.followerSynced[follower]...) {
+				return
+			}
+			for i := 0; i < workers; i++ {
+				go wait.Until(m.runFollowerWorker(follower, queue), time.Second, stopCh)
+			}
+		}()
+	}
+	if period := m.config.Config.RsyncPeriodDuration.Duration; period > 0 {
+		go wait.Until(m.reconcile, period, stopCh)
 	}
 
 	<-stopCh
@@ -106,3 +223,10 @@ func (m *mirrorController) runWorker() {
 	for m.processNextItem() {
 	}
 }
+
+func (m *mirrorController) runFollowerWorker(follower string, queue workqueue.RateLimitingInterface) func() {
+	return func() {
+		for m.processNextFollowerItem(follower, queue) {
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package filter
+
+import (
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+// reconcile 按 RsyncPeriodDuration 定期将主集群中符合条件的资源与各从集群缓存比对，
+// 缺失或不一致的资源会被重新放入对应从集群的队列。已移入死信的资源在手动重试前不会被放入队列
+func (m *mirrorController) reconcile() {
+	var checked, outOfSync int
+	for _, o := range m.indexer.List() {
+		obj, ok := o.(*unstructured.Unstructured)
+		if !ok || !m.match(obj) {
+			continue
+		}
+		checked++
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			continue
+		}
+		followers := m.outOfSync(key, obj)
+		if len(followers) == 0 {
+			continue
+		}
+		outOfSync++
+		for _, follower := range followers {
+			if queue, ok := m.followerQueues[follower]; ok {
+				m.repairing.Store(follower+"/"+key, struct{}{})
+				queue.Add(key)
+			}
+		}
+	}
+	ReconcileObjectCount.WithLabelValues(m.config.Name, "checked").Add(float64(checked))
+	ReconcileObjectCount.WithLabelValues(m.config.Name, "out_of_sync").Add(float64(outOfSync))
+	m.logger.Infof("reconciled %s %s: %d checked, %d out of sync", m.config.Name, m.gvr.String(), checked, outOfSync)
+	m.collectNamespaces()
+}
+
+// outOfSync 返回资源未同步的从集群，跳过已移入死信的从集群
+func (m *mirrorController) outOfSync(key string, obj *unstructured.Unstructured) []string {
+	if m.bidirectional() && !m.revisionOf(m.config.Config.Clusters.Main, obj).modified {
+		return nil
+	}
+	src, _ := json.Marshal(obj)
+	var res []string
+	for _, clusterName := range m.config.Config.Clusters.Follower {
+		cluster, ok := clusterMap[clusterName]
+		if !ok || m.deadLettered(clusterName, key) {
+			continue
+		}
+		lister := m.getTargetLister(cluster)
+		if lister == nil || !m.followerReady(clusterName) {
+			continue
+		}
+		target, err := lister.Get(m.fmtMeta(obj))
+		if err != nil {
+			res = append(res, clusterName)
+			continue
+		}
+		if _, _, state := m.compare(src, target); state != stateSynced {
+			res = append(res, clusterName)
+		}
+	}
+	return res
+}
@@ -0,0 +1,264 @@
+package filter
+
+import (
+	"fmt"
+	"soul-mirror/model"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	// 工作负载中 pod spec 的路径
+	podSpecPaths = map[schema.GroupResource][]string{
+		{Group: "apps", Resource: "deployments"}:  {"spec", "template", "spec"},
+		{Group: "apps", Resource: "statefulsets"}: {"spec", "template", "spec"},
+		{Group: "apps", Resource: "daemonsets"}:   {"spec", "template", "spec"},
+		{Group: "apps", Resource: "replicasets"}:  {"spec", "template", "spec"},
+		{Group: "batch", Resource: "jobs"}:        {"spec", "template", "spec"},
+		{Group: "batch", Resource: "cronjobs"}:    {"spec", "jobTemplate", "spec", "template", "spec"},
+	}
+	referenceGVRs = []schema.GroupVersionResource{
+		{Version: "v1", Resource: "configmaps"},
+		{Version: "v1", Resource: "secrets"},
+		{Version: "v1", Resource: "serviceaccounts"},
+		{Version: "v1", Resource: "persistentvolumeclaims"},
+	}
+)
+
+func isWorkload(gvr schema.GroupVersionResource) bool {
+	_, ok := podSpecPaths[gvr.GroupResource()]
+	return ok
+}
+
+// referenceMirror 生成同步被工作负载引用的资源的隐式mirror配置，使用相同的从集群和filter
+func referenceMirror(obj model.Mirror) model.Mirror {
+	ref := model.Mirror{
+		Name:              obj.Name + "-refs",
+		Config:            obj.Config,
+		Filter:            append([]model.MirrorAction{}, obj.Filter...),
+		IgnoreDifferences: obj.IgnoreDifferences,
+	}
+	ref.Config.TargetName = ""
+	ref.Config.SyncCreate = true
+	ref.Config.SyncDelete = false
+	ref.Config.IncludeReferences = false
+	ref.Config.WriteStatus = false
+	for _, gvr := range referenceGVRs {
+		ref.Resources = append(ref.Resources, model.MirrorSyncTarget{Group: gvr.Group, Version: gvr.Version, Kind: gvr.Resource})
+	}
+	// pvc 绑定的 pv 只存在于主集群
+	ref.Filter = append(ref.Filter, model.MirrorAction{Action: "delete", Key: "spec.volumeName"})
+	return ref
+}
+
+// initReferences 为开启了 includeReferences 的mirror创建隐式mirror，只同步被工作负载引用的资源
+func (c *cluster) initReferences(obj model.Mirror) map[string]*mirrorController {
+	ref := referenceMirror(obj)
+	c.buildMirror(ref, true)
+	res := make(map[string]*mirrorController)
+	for _, gvr := range referenceGVRs {
+		if m, ok := c.mirrors[ref.Name+gvr.String()]; ok {
+			res[gvr.Resource] = m
+		}
+	}
+	return res
+}
+
+// referenceSet 隐式mirror中被引用的资源，以及引用它们的工作负载。没有工作负载引用后不再同步
+type referenceSet struct {
+	mutex  sync.Mutex
+	owners map[string]map[string]struct{}
+}
+
+func newReferenceSet() *referenceSet {
+	return &referenceSet{owners: make(map[string]map[string]struct{})}
+}
+
+func (s *referenceSet) has(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.owners[key]
+	return ok
+}
+
+// add 记录工作负载引用了该资源，返回资源是否为第一次被引用
+func (s *referenceSet) add(key, owner string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	owners, ok := s.owners[key]
+	if !ok {
+		owners = make(map[string]struct{})
+		s.owners[key] = owners
+	}
+	owners[owner] = struct{}{}
+	return !ok
+}
+
+func (s *referenceSet) remove(key, owner string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.owners[key], owner)
+	if len(s.owners[key]) == 0 {
+		delete(s.owners, key)
+	}
+}
+
+// enqueueReferences 将工作负载引用的资源放入隐式mirror的队列，并移除不再被引用的资源
+func (m *mirrorController) enqueueReferences(obj *unstructured.Unstructured) {
+	if len(m.references) == 0 {
+		return
+	}
+	owner := m.fmtMeta(obj)
+	current := make(map[string]struct{})
+	for resource, names := range m.podReferences(obj) {
+		ref, ok := m.references[resource]
+		if !ok {
+			continue
+		}
+		for _, name := range names {
+			key := obj.GetNamespace() + "/" + name
+			current[resource+"/"+key] = struct{}{}
+			if ref.refs.add(key, m.gvr.Resource+"/"+owner) {
+				m.logger.Debugf("mirroring %s %s referenced by %s", resource, key, owner)
+			}
+			// 引用的资源还不存在于主集群时，由隐式mirror的informer在创建后放入队列
+			if _, exists, _ := ref.indexer.GetByKey(key); exists {
+				ref.queue.Add(key)
+			}
+		}
+	}
+	if v, ok := m.referenced.Load(owner); ok {
+		for id := range v.(map[string]struct{}) {
+			if _, ok := current[id]; !ok {
+				m.unreference(id, owner)
+			}
+		}
+	}
+	m.referenced.Store(owner, current)
+}
+
+// dropReferences 工作负载被删除后，移除它引用的资源
+func (m *mirrorController) dropReferences(owner string) {
+	if len(m.references) == 0 {
+		return
+	}
+	if v, ok := m.referenced.LoadAndDelete(owner); ok {
+		for id := range v.(map[string]struct{}) {
+			m.unreference(id, owner)
+		}
+	}
+}
+
+func (m *mirrorController) unreference(id, owner string) {
+	parts := strings.SplitN(id, "/", 2)
+	if ref, ok := m.references[parts[0]]; ok && len(parts) == 2 {
+		ref.refs.remove(parts[1], m.gvr.Resource+"/"+owner)
+		m.logger.Debugf("%s %s is no longer referenced by %s", parts[0], parts[1], owner)
+	}
+}
+
+// podReferences 返回工作负载引用的资源，包括 StatefulSet 由 volumeClaimTemplates 生成的 pvc
+func (m *mirrorController) podReferences(obj *unstructured.Unstructured) map[string][]string {
+	refs := podReferences(obj, podSpecPaths[m.gvr.GroupResource()])
+	if m.gvr.GroupResource() == (schema.GroupResource{Group: "apps", Resource: "statefulsets"}) {
+		if claims := claimTemplateReferences(obj); len(claims) > 0 {
+			if refs == nil {
+				refs = make(map[string][]string)
+			}
+			refs["persistentvolumeclaims"] = append(refs["persistentvolumeclaims"], claims...)
+		}
+	}
+	return refs
+}
+
+// claimTemplateReferences 返回 StatefulSet 的每个副本按 volumeClaimTemplates 使用的 pvc，名字为 <模板>-<StatefulSet>-<序号>
+func claimTemplateReferences(obj *unstructured.Unstructured) []string {
+	templates, _, _ := unstructured.NestedSlice(obj.Object, "spec", "volumeClaimTemplates")
+	replicas, ok, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !ok {
+		replicas = 1
+	}
+	var res []string
+	for _, t := range templates {
+		name, _ := field(t, "metadata", "name").(string)
+		if len(name) == 0 {
+			continue
+		}
+		for i := int64(0); i < replicas; i++ {
+			res = append(res, fmt.Sprintf("%s-%s-%d", name, obj.GetName(), i))
+		}
+	}
+	return res
+}
+
+// podReferences 解析 pod spec 中引用的 configmap、secret、serviceaccount 和 pvc
+func podReferences(obj *unstructured.Unstructured, path []string) map[string][]string {
+	spec, ok, _ := unstructured.NestedMap(obj.Object, path...)
+	if !ok {
+		return nil
+	}
+	refs := make(map[string]map[string]struct{})
+	add := func(resource string, name interface{}) {
+		if n, ok := name.(string); ok && len(n) > 0 {
+			if refs[resource] == nil {
+				refs[resource] = make(map[string]struct{})
+			}
+			refs[resource][n] = struct{}{}
+		}
+	}
+
+	for _, v := range slice(spec["volumes"]) {
+		add("configmaps", field(v, "configMap", "name"))
+		add("secrets", field(v, "secret", "secretName"))
+		add("persistentvolumeclaims", field(v, "persistentVolumeClaim", "claimName"))
+		for _, source := range slice(field(v, "projected", "sources")) {
+			add("configmaps", field(source, "configMap", "name"))
+			add("secrets", field(source, "secret", "name"))
+		}
+	}
+	containers := append(slice(spec["containers"]), slice(spec["initContainers"])...)
+	for _, c := range containers {
+		for _, from := range slice(field(c, "envFrom")) {
+			add("configmaps", field(from, "configMapRef", "name"))
+			add("secrets", field(from, "secretRef", "name"))
+		}
+		for _, env := range slice(field(c, "env")) {
+			add("configmaps", field(env, "valueFrom", "configMapKeyRef", "name"))
+			add("secrets", field(env, "valueFrom", "secretKeyRef", "name"))
+		}
+	}
+	for _, secret := range slice(spec["imagePullSecrets"]) {
+		add("secrets", field(secret, "name"))
+	}
+	// 每个命名空间都有自己的 default serviceaccount
+	if sa, _ := spec["serviceAccountName"].(string); len(sa) > 0 && sa != "default" {
+		add("serviceaccounts", sa)
+	}
+
+	res := make(map[string][]string)
+	for resource, names := range refs {
+		for name := range names {
+			res[resource] = append(res[resource], name)
+		}
+	}
+	return res
+}
+
+func field(obj interface{}, fields ...string) interface{} {
+	for _, f := range fields {
+		m, ok := obj.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		obj = m[f]
+	}
+	return obj
+}
+
+func slice(obj interface{}) []interface{} {
+	s, _ := obj.([]interface{})
+	return s
+}
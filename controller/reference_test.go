@@ -0,0 +1,116 @@
+package filter
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestPodReferences(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		want map[string][]string
+	}{
+		{
+			name: "no references",
+			spec: `{"containers":[{"name":"app","image":"nginx"}]}`,
+			want: map[string][]string{},
+		},
+		{
+			name: "volumes",
+			spec: `{"volumes":[
+				{"name":"a","configMap":{"name":"cm"}},
+				{"name":"b","secret":{"secretName":"secret"}},
+				{"name":"c","persistentVolumeClaim":{"claimName":"data"}}
+			]}`,
+			want: map[string][]string{
+				"configmaps":             {"cm"},
+				"secrets":                {"secret"},
+				"persistentvolumeclaims": {"data"},
+			},
+		},
+		{
+			name: "projected volumes",
+			spec: `{"volumes":[{"name":"a","projected":{"sources":[
+				{"configMap":{"name":"cm"}},
+				{"secret":{"name":"secret"}},
+				{"serviceAccountToken":{"path":"token"}}
+			]}}]}`,
+			want: map[string][]string{
+				"configmaps": {"cm"},
+				"secrets":    {"secret"},
+			},
+		},
+		{
+			name: "envFrom and env",
+			spec: `{
+				"containers":[{"name":"app","envFrom":[{"configMapRef":{"name":"cm"}},{"secretRef":{"name":"secret"}}]}],
+				"initContainers":[{"name":"init","env":[
+					{"name":"A","valueFrom":{"configMapKeyRef":{"name":"init-cm","key":"a"}}},
+					{"name":"B","valueFrom":{"secretKeyRef":{"name":"init-secret","key":"b"}}},
+					{"name":"C","value":"c"}
+				]}]
+			}`,
+			want: map[string][]string{
+				"configmaps": {"cm", "init-cm"},
+				"secrets":    {"init-secret", "secret"},
+			},
+		},
+		{
+			name: "duplicates",
+			spec: `{
+				"volumes":[{"name":"a","configMap":{"name":"cm"}}],
+				"containers":[{"name":"app","envFrom":[{"configMapRef":{"name":"cm"}}]}]
+			}`,
+			want: map[string][]string{"configmaps": {"cm"}},
+		},
+		{
+			name: "image pull secrets and service account",
+			spec: `{"serviceAccountName":"app","imagePullSecrets":[{"name":"registry"}]}`,
+			want: map[string][]string{
+				"secrets":         {"registry"},
+				"serviceaccounts": {"app"},
+			},
+		},
+		{
+			name: "default service account",
+			spec: `{"serviceAccountName":"default"}`,
+			want: map[string][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var spec map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.spec), &spec); err != nil {
+				t.Fatal(err)
+			}
+			obj := &unstructured.Unstructured{Object: map[string]interface{}{
+				"spec": map[string]interface{}{"template": map[string]interface{}{"spec": spec}},
+			}}
+			got := podReferences(obj, []string{"spec", "template", "spec"})
+			for _, names := range got {
+				sort.Strings(names)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podReferences() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimTemplateReferences(t *testing.T) {
+	obj := &unstructured.Unstructured{}
+	obj.SetName("web")
+	_ = unstructured.SetNestedField(obj.Object, int64(2), "spec", "replicas")
+	_ = unstructured.SetNestedSlice(obj.Object, []interface{}{
+		map[string]interface{}{"metadata": map[string]interface{}{"name": "data"}},
+	}, "spec", "volumeClaimTemplates")
+	want := []string{"data-web-0", "data-web-1"}
+	if got := claimTemplateReferences(obj); !reflect.DeepEqual(got, want) {
+		t.Errorf("claimTemplateReferences() = %v, want %v", got, want)
+	}
+}
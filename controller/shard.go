@@ -0,0 +1,104 @@
+package filter
+
+import (
+	"hash/fnv"
+	"sort"
+	"soul-mirror/model"
+	"strconv"
+)
+
+// ringReplicas 每个成员在哈希环上的虚拟节点数
+const ringReplicas = 100
+
+// owns 判断当前副本是否负责该mirror，未开启分片时负责所有mirror
+var owns = func(unit string) bool {
+	return true
+}
+
+// Ring 一致性哈希环，成员变化时只有少量mirror需要迁移
+type Ring struct {
+	hashes []uint64
+	owners map[uint64]string
+}
+
+func NewRing(members []string) *Ring {
+	r := &Ring{owners: make(map[uint64]string)}
+	for _, member := range members {
+		for i := 0; i < ringReplicas; i++ {
+			h := hash(member + "#" + strconv.Itoa(i))
+			r.hashes = append(r.hashes, h)
+			r.owners[h] = member
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	return r
+}
+
+// Owner 返回负责该key的成员
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// unit 分片的单位，每个主集群上的mirror只由一个副本负责。
+// 双向同步的所有对等集群作为一个单位，写入记录和冲突处理都在同一个副本内。
+// 被工作负载引用的资源的隐式mirror跟随工作负载所在的mirror
+func unit(obj model.Mirror) string {
+	if obj.Config.Mode == model.MirrorModeBidirectional {
+		return obj.Name
+	}
+	return obj.Name + "/" + obj.Config.Clusters.Main
+}
+
+// SetOwner 设置当前副本负责的mirror，设置后需要调用 Rebalance
+func SetOwner(f func(unit string) bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	owns = f
+}
+
+// Rebalance 启动新分配给当前副本的mirror，停止不再负责的mirror
+func Rebalance() (started, stopped int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, c := range clusterMap {
+		for _, obj := range c.desired {
+			owned, running := owns(unit(obj)), c.running(obj)
+			switch {
+			case owned && !running:
+				c.initMirror(obj)
+				started++
+			case !owned && running:
+				c.deleteMirror(obj)
+				stopped++
+			}
+		}
+	}
+	return
+}
+
+func (c *cluster) running(obj model.Mirror) bool {
+	for _, m := range c.mirrors {
+		if m.config.Name == obj.Name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package filter
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingOwner(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []string
+		want    string
+	}{
+		{name: "no members"},
+		{name: "single member", members: []string{"a"}, want: "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewRing(tt.members).Owner("mirror/dev"); got != tt.want {
+				t.Errorf("Owner() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// 成员顺序不影响分配
+	a, b := NewRing([]string{"a", "b", "c"}), NewRing([]string{"c", "a", "b"})
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("mirror-%d/dev", i)
+		if a.Owner(key) != b.Owner(key) {
+			t.Fatalf("Owner(%s) = %s and %s for the same members", key, a.Owner(key), b.Owner(key))
+		}
+	}
+}
+
+func TestRingStability(t *testing.T) {
+	tests := []struct {
+		name   string
+		before []string
+		after  []string
+	}{
+		{name: "member added", before: []string{"a", "b"}, after: []string{"a", "b", "c"}},
+		{name: "member removed", before: []string{"a", "b", "c"}, after: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, after := NewRing(tt.before), NewRing(tt.after)
+			changed := make(map[string]bool)
+			for _, m := range tt.before {
+				changed[m] = true
+			}
+			for _, m := range tt.after {
+				changed[m] = !changed[m]
+			}
+			moved := 0
+			const keys = 1000
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("mirror-%d/dev", i)
+				from, to := before.Owner(key), after.Owner(key)
+				if from == to {
+					continue
+				}
+				moved++
+				// 只有加入的成员接管mirror，或者退出的成员交出mirror
+				if !changed[from] && !changed[to] {
+					t.Errorf("Owner(%s) moved from %s to %s", key, from, to)
+				}
+			}
+			if moved == 0 || moved > keys/2 {
+				t.Errorf("%d of %d keys moved", moved, keys)
+			}
+		})
+	}
+}
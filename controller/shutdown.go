@@ -0,0 +1,53 @@
+package filter
+
+import (
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Shutdown 停止所有informer和mirror，等待正在同步的key完成，超过 grace 后取消未完成的请求
+func Shutdown(grace time.Duration) {
+	mutex.Lock()
+	cancel := runCancel
+	runStop, runCancel = nil, nil
+	var mirrors []*mirrorController
+	for _, c := range clusterMap {
+		for _, m := range c.mirrors {
+			mirrors = append(mirrors, m)
+		}
+	}
+	mutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	for _, m := range mirrors {
+		m.close()
+	}
+
+	err := wait.PollImmediate(100*time.Millisecond, grace, func() (bool, error) {
+		for _, m := range mirrors {
+			if !m.idle() {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		for _, m := range mirrors {
+			if n := atomic.LoadInt32(&m.inflight); n > 0 {
+				m.logger.Warnf("%s cancelled %d in-flight keys after %s", m, n, grace)
+			}
+		}
+	}
+	for _, m := range mirrors {
+		m.cancel()
+	}
+}
+
+// idle 没有正在同步的key
+func (m *mirrorController) idle() bool {
+	return atomic.LoadInt32(&m.inflight) == 0
+}
@@ -0,0 +1,202 @@
+package filter
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// MirrorStatus 一个mirror在某个主集群上的同步状态
+type MirrorStatus struct {
+	Name      string           `json:"name"`
+	Main      string           `json:"main"`
+	Followers []string         `json:"followers"`
+	Resources []ResourceStatus `json:"resources"`
+}
+
+type ResourceStatus struct {
+	Resource    string           `json:"resource"`
+	QueueLength int              `json:"queueLength"`
+	Objects     int              `json:"objects"`
+	Followers   []FollowerStatus `json:"followers"`
+}
+
+type FollowerStatus struct {
+	Name          string     `json:"name"`
+	QueueLength   int        `json:"queueLength"`
+	Objects       int        `json:"objects"`
+	LastSyncTime  *time.Time `json:"lastSyncTime,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// ClusterStatus 集群的连接与缓存状态
+type ClusterStatus struct {
+	Name          string          `json:"name"`
+	State         string          `json:"state"`
+	StateSince    time.Time       `json:"stateSince"`
+	ParkedObjects int             `json:"parkedObjects"`
+	Connected     bool            `json:"connected"`
+	ServerVersion string          `json:"serverVersion,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	Informers     map[string]bool `json:"informers"`
+	Caches        map[string]bool `json:"caches"`
+	// 没有权限list/watch的informer及错误
+	Forbidden map[string]string `json:"forbidden,omitempty"`
+}
+
+// followerState 记录mirror同步到某个从集群的结果
+type followerState struct {
+	mutex         sync.Mutex
+	lastSync      time.Time
+	lastError     string
+	lastErrorTime time.Time
+}
+
+func (m *mirrorController) record(follower string, err error) {
+	v, _ := m.followers.LoadOrStore(follower, &followerState{})
+	state := v.(*followerState)
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if err != nil {
+		state.lastError = err.Error()
+		state.lastErrorTime = time.Now()
+		return
+	}
+	state.lastSync = time.Now()
+}
+
+// Mirrors 返回所有mirror的同步状态
+func Mirrors() []MirrorStatus {
+	// 遍历缓存在锁外进行，不阻塞配置更新
+	mutex.Lock()
+	var mirrors []*mirrorController
+	for _, c := range clusterMap {
+		for _, m := range c.mirrors {
+			mirrors = append(mirrors, m)
+		}
+	}
+	mutex.Unlock()
+
+	index := make(map[string]*MirrorStatus)
+	var keys []string
+	for _, m := range mirrors {
+		main := m.config.Config.Clusters.Main
+		key := m.config.Name + "/" + main
+		status, ok := index[key]
+		if !ok {
+			status = &MirrorStatus{
+				Name:      m.config.Name,
+				Main:      main,
+				Followers: m.config.Config.Clusters.Follower,
+			}
+			index[key] = status
+			keys = append(keys, key)
+		}
+		status.Resources = append(status.Resources, m.status())
+	}
+	sort.Strings(keys)
+	res := make([]MirrorStatus, 0, len(keys))
+	for _, key := range keys {
+		sort.Slice(index[key].Resources, func(i, j int) bool {
+			return index[key].Resources[i].Resource < index[key].Resources[j].Resource
+		})
+		res = append(res, *index[key])
+	}
+	return res
+}
+
+func (m *mirrorController) status() ResourceStatus {
+	status := ResourceStatus{
+		Resource:    m.gvr.String(),
+		QueueLength: m.queue.Len(),
+	}
+	var objects []*unstructured.Unstructured
+	for _, o := range m.indexer.List() {
+		obj, ok := o.(*unstructured.Unstructured)
+		if ok && m.match(obj) {
+			objects = append(objects, obj)
+		}
+	}
+	status.Objects = len(objects)
+
+	for _, clusterName := range m.config.Config.Clusters.Follower {
+		follower := FollowerStatus{Name: clusterName}
+		if queue, ok := m.followerQueues[clusterName]; ok {
+			follower.QueueLength = queue.Len()
+		}
+		if cluster, ok := clusterMap[clusterName]; ok && m.getTargetLister(cluster) != nil {
+			for _, obj := range objects {
+				if _, err := m.getTargetLister(cluster).Get(m.fmtMeta(obj)); err == nil {
+					follower.Objects++
+				}
+			}
+		}
+		if v, ok := m.followers.Load(clusterName); ok {
+			state := v.(*followerState)
+			state.mutex.Lock()
+			if !state.lastSync.IsZero() {
+				t := state.lastSync
+				follower.LastSyncTime = &t
+			}
+			if len(state.lastError) > 0 {
+				t := state.lastErrorTime
+				follower.LastError = state.lastError
+				follower.LastErrorTime = &t
+			}
+			state.mutex.Unlock()
+		}
+		status.Followers = append(status.Followers, follower)
+	}
+	return status
+}
+
+// Clusters 返回所有集群的连接与缓存状态
+func Clusters() []ClusterStatus {
+	mutex.Lock()
+	var clusters []*cluster
+	mirrors := make(map[*cluster][]*mirrorController)
+	for _, c := range clusterMap {
+		clusters = append(clusters, c)
+		for _, m := range c.mirrors {
+			mirrors[c] = append(mirrors[c], m)
+		}
+	}
+	mutex.Unlock()
+
+	var res []ClusterStatus
+	for _, c := range clusters {
+		status := ClusterStatus{
+			Name:      c.name,
+			Informers: make(map[string]bool),
+			Caches:    c.caches.Synced(),
+			Forbidden: c.informers.Forbidden(),
+		}
+		for key, err := range c.caches.Forbidden() {
+			status.Forbidden[key] = err
+		}
+		for _, m := range mirrors[c] {
+			status.Informers[m.gvr.String()] = m.hasSynced()
+		}
+		res = append(res, status)
+	}
+
+	// 只读取后台探测记录的状态，不主动探测，避免影响熔断计数
+	for i := range res {
+		h := clusters[i].health
+		h.mutex.Lock()
+		res[i].State = h.state
+		res[i].StateSince = h.since
+		res[i].Error = h.lastError
+		res[i].ServerVersion = h.serverVersion
+		res[i].Connected = len(h.lastError) == 0 && len(h.serverVersion) > 0
+		h.mutex.Unlock()
+		res[i].ParkedObjects = clusters[i].parkedCount()
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
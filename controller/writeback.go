@@ -0,0 +1,165 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"soul-mirror/model"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+var crdGVR = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// conditionTypePrefix condition的类型为 前缀+从集群名称，前缀需要是小写的DNS子域名才能通过 metav1.Condition 的校验
+const conditionTypePrefix = "mirror.soul-mirror.io/"
+
+// statusRetries 写回同步结果冲突时的重试次数
+const statusRetries = 5
+
+// objectStatus 资源同步到某个从集群的结果
+type objectStatus struct {
+	Hash       string `json:"hash,omitempty"`
+	Generation int64  `json:"generation,omitempty"`
+	Time       string `json:"time"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (s objectStatus) equal(other objectStatus) bool {
+	return s.Hash == other.Hash && s.Generation == other.Generation && s.Error == other.Error
+}
+
+func newObjectStatus(obj *unstructured.Unstructured, hash string, err error) objectStatus {
+	status := objectStatus{Generation: obj.GetGeneration(), Time: time.Now().UTC().Format(time.RFC3339)}
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Hash = hash
+	}
+	return status
+}
+
+// writeStatus 将每个从集群的同步结果写回主集群的资源。
+// 带有status子资源的CRD写入 status.conditions，其他资源写入注解。只有结果变化时才写入，避免触发新的同步
+func (m *mirrorController) writeStatus(obj *unstructured.Unstructured, results map[string]objectStatus) {
+	if !m.config.Config.WriteStatus || m.dryRun() || len(results) == 0 {
+		return
+	}
+	var client dynamic.ResourceInterface = m.client.Resource(m.gvr)
+	if len(obj.GetNamespace()) > 0 {
+		client = m.client.Resource(m.gvr).Namespace(obj.GetNamespace())
+	}
+
+	write := m.writeAnnotation
+	if m.statusSubresource() {
+		write = m.writeConditions
+	}
+	// 以缓存中的资源为准合并，写入时带上资源版本，多个从集群并发写回冲突时获取最新的资源重试
+	err := write(client, obj, results)
+	for i := 0; i < statusRetries && errors.IsConflict(err); i++ {
+		var latest *unstructured.Unstructured
+		if latest, err = client.Get(m.ctx, obj.GetName(), metav1.GetOptions{}); err == nil {
+			err = write(client, latest, results)
+		}
+	}
+	if err != nil {
+		m.logger.WithError(err).Warnf("failed to write sync status to %s", m.fmtMeta(obj))
+	}
+}
+
+func (m *mirrorController) writeAnnotation(client dynamic.ResourceInterface, obj *unstructured.Unstructured, results map[string]objectStatus) error {
+	current := make(map[string]objectStatus)
+	_ = json.Unmarshal([]byte(obj.GetAnnotations()[model.SyncStatusAnnotation]), &current)
+	changed := false
+	for follower, status := range results {
+		if old, ok := current[follower]; !ok || !old.equal(status) {
+			current[follower] = status
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	value, _ := json.Marshal(current)
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": obj.GetResourceVersion(),
+			"annotations":     map[string]string{model.SyncStatusAnnotation: string(value)},
+		},
+	})
+	_, err := client.Patch(m.ctx, obj.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func (m *mirrorController) writeConditions(client dynamic.ResourceInterface, obj *unstructured.Unstructured, results map[string]objectStatus) error {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	changed := false
+	for follower, status := range results {
+		condition := map[string]interface{}{
+			"type":               conditionTypePrefix + follower,
+			"status":             string(metav1.ConditionTrue),
+			"observedGeneration": status.Generation,
+			"reason":             "Synced",
+			"message":            fmt.Sprintf("synced content %s", status.Hash),
+			"lastTransitionTime": status.Time,
+		}
+		if len(status.Error) > 0 {
+			condition["status"] = string(metav1.ConditionFalse)
+			condition["reason"] = "Failed"
+			condition["message"] = status.Error
+		}
+		found := false
+		for i, c := range conditions {
+			old, ok := c.(map[string]interface{})
+			if !ok || old["type"] != condition["type"] {
+				continue
+			}
+			found = true
+			if old["status"] != condition["status"] || old["reason"] != condition["reason"] || old["message"] != condition["message"] {
+				// 只有状态变化时才更新 lastTransitionTime
+				if old["status"] == condition["status"] && old["lastTransitionTime"] != nil {
+					condition["lastTransitionTime"] = old["lastTransitionTime"]
+				}
+				conditions[i] = condition
+				changed = true
+			}
+		}
+		if !found {
+			conditions = append(conditions, condition)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	res := obj.DeepCopy()
+	if err := unstructured.SetNestedSlice(res.Object, conditions, "status", "conditions"); err != nil {
+		return err
+	}
+	_, err := client.UpdateStatus(m.ctx, res, metav1.UpdateOptions{})
+	return err
+}
+
+// statusSubresource 判断资源是否为开启了status子资源的CRD，结果只查询一次
+func (m *mirrorController) statusSubresource() bool {
+	m.statusOnce.Do(func() {
+		crd, err := m.client.Resource(crdGVR).Get(m.ctx, m.gvr.Resource+"."+m.gvr.Group, metav1.GetOptions{})
+		if err != nil {
+			return
+		}
+		versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+		for _, v := range versions {
+			version, ok := v.(map[string]interface{})
+			if !ok || version["name"] != m.gvr.Version {
+				continue
+			}
+			_, m.hasStatus, _ = unstructured.NestedMap(version, "subresources", "status")
+		}
+	})
+	return m.hasStatus
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"soul-mirror/controller"
+	"soul-mirror/model"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// elect 参与选举，成为leader后执行 run。收到信号时先等待 run 停止写入再释放 Lease；
+// 失去leader时不释放 Lease，run 的等待时间不超过其他副本可以成为leader之前的时间
+func elect(ctx context.Context, appCfg *model.Config, run func(ctx context.Context, limit func() time.Duration)) error {
+	e := electionDefaults(appCfg.Election)
+	client, err := leaseClient(appCfg, e.Cluster)
+	if err != nil {
+		return err
+	}
+
+	id := identity()
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: e.LeaseName, Namespace: e.Namespace},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: id},
+	}
+	// 选举在 run 停止写入后才结束，结束前一直续约
+	electCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leading := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-electCtx.Done():
+			return
+		}
+		select {
+		case <-leading:
+			<-done
+		default:
+		}
+		cancel()
+	}()
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: e.LeaseDuration.Duration,
+		RenewDeadline: e.RenewDeadline.Duration,
+		RetryPeriod:   e.RetryPeriod.Duration,
+		Name:          e.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				close(leading)
+				defer close(done)
+				logrus.Infof("%s became leader of %s/%s", id, e.Namespace, e.LeaseName)
+				runCtx, stop := context.WithCancel(leaderCtx)
+				defer stop()
+				go func() {
+					select {
+					case <-ctx.Done():
+						stop()
+					case <-runCtx.Done():
+					}
+				}()
+				run(runCtx, func() time.Duration {
+					if ctx.Err() != nil {
+						return 0
+					}
+					// 最后一次续约成功后 renewDeadline 才失去leader，其他副本在 leaseDuration 后才能成为leader
+					return leaseRemaining(e)
+				})
+			},
+			OnStoppedLeading: func() {
+				logrus.Warnf("%s stopped leading %s/%s", id, e.Namespace, e.LeaseName)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != id {
+					logrus.Infof("current leader of %s/%s is %s", e.Namespace, e.LeaseName, identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	elector.Run(electCtx)
+
+	// 等待mirror停止写入
+	select {
+	case <-leading:
+		<-done
+		if ctx.Err() != nil {
+			releaseLease(lock, id)
+		}
+	default:
+	}
+	return nil
+}
+
+// leaseRemaining 失去leader后到其他副本可以成为leader之前的时间，留出一个 retryPeriod 的余量
+func leaseRemaining(e model.Election) time.Duration {
+	remaining := e.LeaseDuration.Duration - e.RenewDeadline.Duration
+	if remaining > e.RetryPeriod.Duration {
+		remaining -= e.RetryPeriod.Duration
+	}
+	return remaining
+}
+
+// releaseLease mirror停止写入后释放 Lease，其他副本不需要等待 Lease 过期
+func releaseLease(lock *resourcelock.LeaseLock, id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	record, _, err := lock.Get(ctx)
+	if err != nil || record.HolderIdentity != id {
+		return
+	}
+	now := metav1.Now()
+	err = lock.Update(ctx, resourcelock.LeaderElectionRecord{
+		LeaderTransitions:    record.LeaderTransitions,
+		LeaseDurationSeconds: 1,
+		RenewTime:            now,
+		AcquireTime:          now,
+	})
+	if err != nil {
+		logrus.WithError(err).Warnf("unable to release lease %s", lock.Describe())
+	}
+}
+
+// leaseClient 返回访问 Lease 所在集群的客户端，cluster 为空时使用 soul-mirror 运行的集群
+func leaseClient(appCfg *model.Config, cluster string) (kubernetes.Interface, error) {
+	var restCfg *rest.Config
+	var err error
+	if len(cluster) == 0 {
+		restCfg, err = config.GetConfig()
+	} else {
+		for _, c := range appCfg.Clusters {
+			if c.Name == cluster {
+				restCfg, err = filter.RESTConfig(&c)
+			}
+		}
+		if restCfg == nil && err == nil {
+			err = fmt.Errorf("cluster %s not found", cluster)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restCfg)
+}
+
+func identity() string {
+	hostname, _ := os.Hostname()
+	return hostname + "_" + string(uuid.NewUUID())
+}
+
+// currentNamespace 返回 soul-mirror 运行的命名空间
+func currentNamespace() string {
+	if b, err := ioutil.ReadFile(namespaceFile); err == nil && len(strings.TrimSpace(string(b))) > 0 {
+		return strings.TrimSpace(string(b))
+	}
+	return "default"
+}
+
+func electionDefaults(e model.Election) model.Election {
+	if len(e.LeaseName) == 0 {
+		e.LeaseName = "soul-mirror-service-controller-election"
+	}
+	if len(e.Namespace) == 0 {
+		e.Namespace = currentNamespace()
+	}
+	if e.LeaseDuration.Duration == 0 {
+		e.LeaseDuration.Duration = 15 * time.Second
+	}
+	if e.RenewDeadline.Duration == 0 {
+		e.RenewDeadline.Duration = 10 * time.Second
+	}
+	if e.RetryPeriod.Duration == 0 {
+		e.RetryPeriod.Duration = 2 * time.Second
+	}
+	return e
+}
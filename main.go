@@ -7,42 +7,88 @@ import (
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"os/signal"
+	"reflect"
 	"soul-mirror/controller"
 	"soul-mirror/model"
+	"syscall"
 	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/diode"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
-	"sigs.k8s.io/controller-runtime/pkg/client/config"
-	"sigs.k8s.io/controller-runtime/pkg/manager"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var (
 	loglevel       = flag.String("loglevel", "info", "info, debug, trace")
 	enableElection = flag.Bool("enable-election", false, "用于开启选举")
+	dryRun         = flag.Bool("dry-run", false, "只记录将要对从集群做的修改，不实际写入")
 )
 
+var logWriter diode.Writer
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	wr := diode.NewWriter(os.Stdout, 1000, 10*time.Millisecond, func(missed int) {
+	logWriter = diode.NewWriter(os.Stdout, 1000, 10*time.Millisecond, func(missed int) {
 		fmt.Printf("Logger Dropped %d messages", missed)
 	})
-	logrus.SetOutput(wr)
-
-	go app()
-	sync(getConfig())
-}
-
-func app() {
-	router := http.NewServeMux()
+	logrus.SetOutput(logWriter)
+	logrus.RegisterExitHandler(func() {
+		_ = logWriter.Close()
+	})
 	level, err := logrus.ParseLevel(*loglevel)
 	if err != nil {
 		logrus.WithError(err).Fatalf("failed to parse loglevel")
 	}
 	logrus.SetLevel(level)
+	filter.SetDryRun(*dryRun)
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"run"}
+	}
+	switch args[0] {
+	case "run":
+		go app()
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		go func() {
+			<-ctx.Done()
+			// 再次收到信号时直接退出
+			stop()
+			logrus.Info("shutting down")
+		}()
+		sync(ctx, getConfig())
+		exit(0)
+	case "validate":
+		exit(validate(getConfig()))
+	case "diff":
+		exit(diff(getConfig(), args[1:]))
+	case "sync-once":
+		exit(syncOnce(getConfig()))
+	case "migrate":
+		exit(migrate(getConfig(), args[1:]))
+	default:
+		flag.Usage()
+		exit(2)
+	}
+}
+
+// exit 退出前写完缓冲中的日志
+func exit(code int) {
+	_ = logWriter.Close()
+	os.Exit(code)
+}
+
+func app() {
+	router := http.NewServeMux()
 
 	router.HandleFunc("/debug/pprof/", pprof.Index)
 	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -67,36 +113,86 @@ func app() {
 	router.HandleFunc("/health", func(writer http.ResponseWriter, request *http.Request) {
 		_, _ = writer.Write([]byte("ok"))
 	})
+	router.HandleFunc("/mirrors", mirrorsHandler)
+	router.HandleFunc("/mirrors/", mirrorHandler)
+	router.HandleFunc("/clusters", clustersHandler)
+	router.HandleFunc("/deadletter", deadLetterHandler)
+	router.HandleFunc("/deadletter/", deadLetterHandler)
 	ph := promhttp.Handler()
 	router.Handle("/metrics", ph)
 
-	err = http.ListenAndServe(":9527", router)
+	err := http.ListenAndServe(":9527", router)
 	if err != nil {
 		logrus.WithError(err).Fatalf("failed to listen 9527")
 	}
 }
 
-func sync(appCfg *model.Config) {
-	// 选举
-	if *enableElection {
-		localCfg := config.GetConfigOrDie()
-		mgr, err := manager.New(localCfg, manager.Options{
-			LeaderElection:   true,
-			LeaderElectionID: "soul-mirror-service-controller-election",
+func sync(ctx context.Context, appCfg *model.Config) {
+	if errs := appCfg.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			logrus.Error(err)
+		}
+		logrus.Fatal("invalid config")
+	}
+	for _, cycle := range appCfg.Cycles() {
+		if appCfg.LoopDetection == model.LoopDetectionRefuse {
+			logrus.Fatalf("mirrors form a cycle %s", cycle)
+		}
+		logrus.Warnf("mirrors form a cycle %s", cycle)
+	}
+
+	// 分片，所有副本同时运行
+	if appCfg.Sharding.Enabled {
+		err := shardMirrors(ctx, appCfg, func(ctx context.Context) {
+			run(ctx, appCfg, nil)
 		})
 		if err != nil {
-			logrus.WithError(err).Fatal("unable to set up overall controller manager")
+			logrus.WithError(err).Fatal("unable to set up sharding")
 		}
-		go func() {
-			err = mgr.Start(context.TODO())
-			if err != nil {
-				logrus.WithError(err).Fatal("unable to start controller manager")
-			}
-		}()
-		ech := mgr.Elected()
-		<-ech
+		return
+	}
+
+	if !*enableElection && !appCfg.Election.Enabled {
+		run(ctx, appCfg, nil)
+		return
 	}
 
+	// 选举
+	err := elect(ctx, appCfg, func(ctx context.Context, limit func() time.Duration) {
+		run(ctx, appCfg, limit)
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to set up leader election")
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	// 失去leader后mirror已经停止，退出后重新参与选举
+	logrus.Error("leadership lost, all mirrors stopped")
+	exit(1)
+}
+
+// run 启动所有mirror，ctx 结束时停止informer，等待正在同步的资源完成。limit 返回大于0的值时等待时间不超过该值
+func run(ctx context.Context, appCfg *model.Config, limit func() time.Duration) {
+	initMirrors(appCfg)
+	filter.Start(ctx)
+	<-ctx.Done()
+
+	grace := appCfg.ShutdownGracePeriod.Duration
+	if grace == 0 {
+		grace = 20 * time.Second
+	}
+	if limit != nil {
+		if max := limit(); max > 0 && max < grace {
+			logrus.Warnf("leadership lost, waiting at most %s for in-flight keys", max)
+			grace = max
+		}
+	}
+	filter.Shutdown(grace)
+	logrus.Info("all mirrors stopped")
+}
+
+func initMirrors(appCfg *model.Config) {
 	for _, c := range appCfg.Clusters {
 		err := filter.UpdateCluster(&c)
 		if err != nil {
@@ -107,9 +203,6 @@ func sync(appCfg *model.Config) {
 		filter.UpdateMirror(m)
 		logrus.Infof("filter %v running", m.Name)
 	}
-	s := make(chan struct{})
-	filter.Start(s)
-	<-s
 }
 
 func getConfig() *model.Config {
@@ -123,7 +216,7 @@ func getConfig() *model.Config {
 	}
 
 	clusters := &model.Config{}
-	err = viper.Unmarshal(clusters)
+	err = viper.Unmarshal(clusters, viper.DecodeHook(decodeHook()))
 	if err != nil {
 		logrus.WithError(err).Fatalf("failed to read clsuter getConfig")
 	}
@@ -132,9 +225,24 @@ func getConfig() *model.Config {
 	if err != nil {
 		logrus.WithError(err).Fatalf("failed to read clsuter getConfig")
 	}
-	err = viper.Unmarshal(clusters)
+	err = viper.Unmarshal(clusters, viper.DecodeHook(decodeHook()))
 	if err != nil {
 		logrus.WithError(err).Fatalf("failed to read clsuter getConfig")
 	}
 	return clusters
 }
+
+// decodeHook 在viper默认hook的基础上支持将 "10m" 这样的字符串解析为 metav1.Duration
+func decodeHook() mapstructure.DecodeHookFunc {
+	return mapstructure.ComposeDecodeHookFunc(
+		func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+			if from.Kind() != reflect.String || to != reflect.TypeOf(metav1.Duration{}) {
+				return data, nil
+			}
+			d, err := time.ParseDuration(data.(string))
+			return metav1.Duration{Duration: d}, err
+		},
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	)
+}
@@ -16,13 +16,64 @@ limitations under the License.
 
 package model
 
+import metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
 type Cluster struct {
 	Name       string `json:"name,omitempty"`
 	Config     string `json:"config,omitempty"`
 	ConfigPath string `json:"configPath,omitempty"`
+	// client rate limit, default to client-go's 5 qps and 10 burst
+	QPS   float32 `json:"qps,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+	// request timeout, 0 means no timeout
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+	// write budget shared by all mirrors following this cluster, 0 means unlimited
+	WriteQPS   float32 `json:"writeQPS,omitempty"`
+	WriteBurst int     `json:"writeBurst,omitempty"`
+	// watch (default) or poll for clusters that only allow list and get
+	Mode string `json:"mode,omitempty"`
+	// list interval in poll mode, default 30s
+	PollInterval metav1.Duration `json:"pollInterval,omitempty"`
 }
 
 type Config struct {
 	Clusters []Cluster `json:"clusters,omitempty"`
 	Mirrors  []Mirror  `json:"mirrors,omitempty"`
+	// what to do when mirrors form a cycle: warn or refuse
+	LoopDetection string `json:"loopDetection,omitempty"`
+	// leader election between replicas
+	Election Election `json:"election,omitempty"`
+	// distribute mirrors across replicas, takes precedence over election
+	Sharding Sharding `json:"sharding,omitempty"`
+	// how long to wait for in-flight objects on SIGTERM/SIGINT, default 20s
+	ShutdownGracePeriod metav1.Duration `json:"shutdownGracePeriod,omitempty"`
+}
+
+type Sharding struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// cluster holding the member leases, empty for the cluster soul-mirror runs in
+	Cluster string `json:"cluster,omitempty"`
+	// replicas with the same group share mirrors, default soul-mirror
+	Group string `json:"group,omitempty"`
+	// default the namespace soul-mirror runs in
+	Namespace string `json:"namespace,omitempty"`
+	// members not renewed within leaseDuration are removed, default 15s
+	LeaseDuration metav1.Duration `json:"leaseDuration,omitempty"`
+	// default 5s
+	RenewPeriod metav1.Duration `json:"renewPeriod,omitempty"`
+}
+
+type Election struct {
+	// also enabled by --enable-election
+	Enabled bool `json:"enabled,omitempty"`
+	// cluster holding the lease, empty for the cluster soul-mirror runs in
+	Cluster string `json:"cluster,omitempty"`
+	// default soul-mirror-service-controller-election
+	LeaseName string `json:"leaseName,omitempty"`
+	// default the namespace soul-mirror runs in
+	Namespace string `json:"namespace,omitempty"`
+	// default 15s, 10s and 2s
+	LeaseDuration metav1.Duration `json:"leaseDuration,omitempty"`
+	RenewDeadline metav1.Duration `json:"renewDeadline,omitempty"`
+	RetryPeriod   metav1.Duration `json:"retryPeriod,omitempty"`
 }
@@ -3,4 +3,54 @@ package model
 const (
 	Finalizers                = "soul-mirror/finalizers"
 	ResourceVersionAnnotation = "soul-mirror/source-resource-version"
+	ContentHashAnnotation     = "soul-mirror/content-hash"
+	// 写入的内容去掉集群维护的字段后的摘要，与mirror的配置无关
+	WrittenHashAnnotation     = "soul-mirror/written-hash"
+	OriginClusterAnnotation   = "soul-mirror/origin-cluster"
+	LogicalVersionAnnotation  = "soul-mirror/logical-version"
+	OriginTimestampAnnotation = "soul-mirror/origin-timestamp"
+	// 资源依次经过的集群，逗号分隔
+	MirrorPathAnnotation = "soul-mirror/mirror-path"
+	// 写回主集群资源的每个从集群的同步结果
+	SyncStatusAnnotation = "soul-mirror/sync-status"
+	// 由soul-mirror创建的命名空间，注解的值为创建它的mirror，同名标签的值为 true
+	ManagedNamespaceAnnotation = "soul-mirror/managed-namespace"
+	// 冲突策略为 manual 时，带有该注解的资源会覆盖其他对等集群中的修改
+	ConflictWinnerAnnotation = "soul-mirror/conflict-winner"
+)
+
+const (
+	MirrorModeBidirectional = "bidirectional"
+)
+
+const (
+	// 通过watch获取资源的变化，默认值
+	ClusterModeWatch = "watch"
+	// 集群只允许 list/get 时定期list资源，而不是watch
+	ClusterModePoll = "poll"
+)
+
+const (
+	// 加载配置时发现环只打印警告，默认值
+	LoopDetectionWarn = "warn"
+	// 加载配置时发现环拒绝启动
+	LoopDetectionRefuse = "refuse"
+)
+
+const (
+	// 以最后修改时间较晚的为准，默认值
+	ConflictStrategyLastWriterWins = "lastWriterWins"
+	// 以 peers 中靠前的集群为准
+	ConflictStrategyPriority = "priority"
+	// 记录冲突，等待人工处理
+	ConflictStrategyManual = "manual"
+)
+
+const (
+	// 覆盖从集群中的修改，默认值
+	DriftPolicyCorrect = "correct"
+	// 只记录日志和指标
+	DriftPolicyReport = "report"
+	// 不检查从集群中的修改
+	DriftPolicyIgnore = "ignore"
 )
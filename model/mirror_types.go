@@ -28,6 +28,8 @@ type Mirror struct {
 	Resources []MirrorSyncTarget    `json:"resources,omitempty"`
 	Selector  *metav1.LabelSelector `json:"selector,omitempty"`
 	Filter    []MirrorAction        `json:"filter,omitempty"`
+	// fields changed in followers by other actors, excluded from drift comparison and kept from the follower on write
+	IgnoreDifferences []MirrorIgnoreDifference `json:"ignoreDifferences,omitempty"`
 }
 
 type MirrorCluster struct {
@@ -35,12 +37,16 @@ type MirrorCluster struct {
 	Main string `json:"master,omitempty"`
 	// +kubebuilder:validation:MinItems:=1
 	Follower []string `json:"follower,omitempty"`
+	// clusters synced with each other in bidirectional mode, ordered by priority
+	Peers []string `json:"peers,omitempty"`
 }
 
 type MirrorSyncConfig struct {
 	// +kubebuilder:validation:Required
-	Clusters            MirrorCluster   `json:"clusters,omitempty"`
-	Namespace           string          `json:"namespace,omitempty"`
+	Clusters  MirrorCluster `json:"clusters,omitempty"`
+	Namespace string        `json:"namespace,omitempty"`
+	// only sync these namespaces, informers are started per namespace
+	Namespaces          []string        `json:"namespaces,omitempty"`
 	NotInNamespace      string          `json:"notInNamespace,omitempty"`
 	RsyncPeriodDuration metav1.Duration `json:"rsyncPeriodDuration,omitempty"`
 	TargetName          string          `json:"targetName,omitempty"`
@@ -48,6 +54,39 @@ type MirrorSyncConfig struct {
 	SyncCreate bool `json:"syncCreate,omitempty"`
 	// delete if source is delete
 	SyncDelete bool `json:"syncDelete,omitempty"`
+	// how to handle changes made directly in followers: correct, report or ignore
+	DriftPolicy string `json:"driftPolicy,omitempty"`
+	// empty for main to followers, or bidirectional between peers
+	Mode string `json:"mode,omitempty"`
+	// how to resolve concurrent changes in bidirectional mode: lastWriterWins, priority or manual
+	ConflictStrategy string `json:"conflictStrategy,omitempty"`
+	// log what would change in followers instead of writing
+	DryRun bool `json:"dryRun,omitempty"`
+	// do not emit kubernetes events on source objects
+	DisableEvents bool `json:"disableEvents,omitempty"`
+	// also emit kubernetes events on follower objects
+	FollowerEvents bool `json:"followerEvents,omitempty"`
+	// write per-follower sync status back to source objects
+	WriteStatus bool `json:"writeStatus,omitempty"`
+	// create missing namespaces in followers
+	CreateNamespace MirrorNamespace `json:"createNamespace,omitempty"`
+	// also mirror configmaps, secrets, serviceaccounts and pvcs referenced by workloads
+	IncludeReferences bool `json:"includeReferences,omitempty"`
+	// workers per follower, default 8
+	Workers int `json:"workers,omitempty"`
+	// retry backoff bounds for failed keys
+	Backoff MirrorBackoff `json:"backoff,omitempty"`
+	// give up a key after this many retries, 0 means retry forever
+	MaxRetries int `json:"maxRetries,omitempty"`
+	// only cache metadata of follower objects, drift in content is not detected
+	MetadataOnlyCache bool `json:"metadataOnlyCache,omitempty"`
+}
+
+type MirrorBackoff struct {
+	// default 5ms
+	Base metav1.Duration `json:"base,omitempty"`
+	// default 1000s
+	Max metav1.Duration `json:"max,omitempty"`
 }
 
 type MirrorSyncTarget struct {
@@ -61,3 +100,21 @@ type MirrorAction struct {
 	Key    string `json:"key,omitempty"`
 	Value  string `json:"value,omitempty"`
 }
+
+type MirrorIgnoreDifference struct {
+	// optional scope, empty means any
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	// +kubebuilder:validation:MinItems:=1
+	Paths []string `json:"paths,omitempty"`
+}
+
+type MirrorNamespace struct {
+	Enabled     bool              `json:"enabled,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// delete created namespaces once nothing in them is mirrored
+	GarbageCollect bool `json:"garbageCollect,omitempty"`
+}
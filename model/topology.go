@@ -0,0 +1,98 @@
+package model
+
+import (
+	"sort"
+	"strings"
+)
+
+// Cycle 同一类资源在集群之间形成的同步环
+type Cycle struct {
+	Resource string
+	Path     []string
+}
+
+func (c Cycle) String() string {
+	return c.Resource + ": " + strings.Join(c.Path, " -> ")
+}
+
+// Cycles 将同步配置视为有向图，每个mirror按资源类型贡献从主集群到各从集群的边，返回图中的环。
+// 双向同步的mirror有单独的回声抑制机制，不参与分析
+func (c *Config) Cycles() []Cycle {
+	graphs := make(map[string]map[string][]string)
+	for _, m := range c.Mirrors {
+		if m.Config.Mode == MirrorModeBidirectional {
+			continue
+		}
+		for _, r := range m.Resources {
+			// 同一资源的不同版本指向相同的对象
+			resource := r.Kind
+			if len(r.Group) > 0 {
+				resource = r.Kind + "." + r.Group
+			}
+			graph, ok := graphs[resource]
+			if !ok {
+				graph = make(map[string][]string)
+				graphs[resource] = graph
+			}
+			graph[m.Config.Clusters.Main] = append(graph[m.Config.Clusters.Main], m.Config.Clusters.Follower...)
+		}
+	}
+
+	var cycles []Cycle
+	resources := make([]string, 0, len(graphs))
+	for resource := range graphs {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	for _, resource := range resources {
+		for _, path := range findCycles(graphs[resource]) {
+			cycles = append(cycles, Cycle{Resource: resource, Path: path})
+		}
+	}
+	return cycles
+}
+
+// findCycles 深度优先遍历，每条回边对应一个环
+func findCycles(graph map[string][]string) [][]string {
+	const (
+		white = iota
+		gray
+		black
+	)
+	color := make(map[string]int)
+	var stack []string
+	var cycles [][]string
+	var visit func(node string)
+	visit = func(node string) {
+		color[node] = gray
+		stack = append(stack, node)
+		for _, next := range graph[node] {
+			switch color[next] {
+			case white:
+				visit(next)
+			case gray:
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == next {
+						path := append([]string{}, stack[i:]...)
+						cycles = append(cycles, append(path, next))
+						break
+					}
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		color[node] = black
+	}
+
+	nodes := make([]string, 0, len(graph))
+	for node := range graph {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		if color[node] == white {
+			visit(node)
+		}
+	}
+	return cycles
+}
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mirror(name, main string, followers ...string) Mirror {
+	return Mirror{
+		Name:      name,
+		Resources: []MirrorSyncTarget{{Version: "v1", Kind: "configmaps"}},
+		Config: MirrorSyncConfig{
+			Clusters: MirrorCluster{Main: main, Follower: followers},
+		},
+	}
+}
+
+func TestCycles(t *testing.T) {
+	tests := []struct {
+		name    string
+		mirrors []Mirror
+		want    []Cycle
+	}{
+		{
+			name:    "no cycle",
+			mirrors: []Mirror{mirror("a-b", "a", "b"), mirror("b-c", "b", "c")},
+		},
+		{
+			name:    "A->A",
+			mirrors: []Mirror{mirror("a-a", "a", "a")},
+			want:    []Cycle{{Resource: "configmaps", Path: []string{"a", "a"}}},
+		},
+		{
+			name:    "A->B->A",
+			mirrors: []Mirror{mirror("a-b", "a", "b"), mirror("b-a", "b", "a")},
+			want:    []Cycle{{Resource: "configmaps", Path: []string{"a", "b", "a"}}},
+		},
+		{
+			name:    "A->B->C->A",
+			mirrors: []Mirror{mirror("a-b", "a", "b"), mirror("b-c", "b", "c"), mirror("c-a", "c", "a")},
+			want:    []Cycle{{Resource: "configmaps", Path: []string{"a", "b", "c", "a"}}},
+		},
+		{
+			name: "bidirectional ignored",
+			mirrors: func() []Mirror {
+				m := mirror("peers", "a", "b")
+				m.Config.Mode = MirrorModeBidirectional
+				return []Mirror{m, mirror("b-a", "b", "a")}
+			}(),
+		},
+		{
+			name: "different resources",
+			mirrors: func() []Mirror {
+				m := mirror("b-a", "b", "a")
+				m.Resources = []MirrorSyncTarget{{Version: "v1", Kind: "secrets"}}
+				return []Mirror{mirror("a-b", "a", "b"), m}
+			}(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Mirrors: tt.mirrors}
+			if got := c.Cycles(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Cycles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Validate 检查配置是否完整、引用的集群是否存在，返回所有发现的问题
+func (c *Config) Validate() []error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	clusters := make(map[string]bool)
+	for i, cluster := range c.Clusters {
+		if len(cluster.Name) == 0 {
+			add("clusters[%d]: name is required", i)
+			continue
+		}
+		if clusters[cluster.Name] {
+			add("cluster %s: duplicated name", cluster.Name)
+		}
+		clusters[cluster.Name] = true
+		if len(cluster.Config) == 0 && len(cluster.ConfigPath) == 0 {
+			add("cluster %s: config or configPath is required", cluster.Name)
+		}
+		if cluster.QPS < 0 || cluster.Burst < 0 || cluster.Timeout.Duration < 0 || cluster.WriteQPS < 0 || cluster.WriteBurst < 0 {
+			add("cluster %s: qps, burst, timeout, writeQPS and writeBurst must not be negative", cluster.Name)
+		}
+		switch cluster.Mode {
+		case "", ClusterModeWatch, ClusterModePoll:
+		default:
+			add("cluster %s: unknown mode %q", cluster.Name, cluster.Mode)
+		}
+		if cluster.PollInterval.Duration < 0 {
+			add("cluster %s: pollInterval must not be negative", cluster.Name)
+		}
+	}
+	checkCluster := func(mirror, field, name string) {
+		if !clusters[name] {
+			add("mirror %s: %s cluster %q not found", mirror, field, name)
+		}
+	}
+
+	if e := c.Election; len(e.Cluster) > 0 && !clusters[e.Cluster] {
+		add("election: cluster %q not found", e.Cluster)
+	}
+	if e := c.Election; e.LeaseDuration.Duration < 0 || e.RenewDeadline.Duration < 0 || e.RetryPeriod.Duration < 0 {
+		add("election: leaseDuration, renewDeadline and retryPeriod must not be negative")
+	}
+
+	if s := c.Sharding; len(s.Cluster) > 0 && !clusters[s.Cluster] {
+		add("sharding: cluster %q not found", s.Cluster)
+	}
+	if s := c.Sharding; s.LeaseDuration.Duration < 0 || s.RenewPeriod.Duration < 0 {
+		add("sharding: leaseDuration and renewPeriod must not be negative")
+	}
+
+	if c.ShutdownGracePeriod.Duration < 0 {
+		add("shutdownGracePeriod must not be negative")
+	}
+
+	switch c.LoopDetection {
+	case "", LoopDetectionWarn, LoopDetectionRefuse:
+	default:
+		add("unknown loopDetection %q", c.LoopDetection)
+	}
+
+	mirrors := make(map[string]bool)
+	for i, m := range c.Mirrors {
+		if len(m.Name) == 0 {
+			add("mirrors[%d]: name is required", i)
+			continue
+		}
+		if mirrors[m.Name] {
+			add("mirror %s: duplicated name", m.Name)
+		}
+		mirrors[m.Name] = true
+
+		switch m.Config.Mode {
+		case "":
+			if len(m.Config.Clusters.Main) == 0 {
+				add("mirror %s: main cluster is required", m.Name)
+			} else {
+				checkCluster(m.Name, "main", m.Config.Clusters.Main)
+			}
+			if len(m.Config.Clusters.Follower) == 0 {
+				add("mirror %s: at least one follower is required", m.Name)
+			}
+			for _, follower := range m.Config.Clusters.Follower {
+				checkCluster(m.Name, "follower", follower)
+			}
+		case MirrorModeBidirectional:
+			if len(m.Config.Clusters.Peers) < 2 {
+				add("mirror %s: bidirectional mode requires at least two peers", m.Name)
+			}
+			for _, peer := range m.Config.Clusters.Peers {
+				checkCluster(m.Name, "peer", peer)
+			}
+		default:
+			add("mirror %s: unknown mode %q", m.Name, m.Config.Mode)
+		}
+
+		switch m.Config.DriftPolicy {
+		case "", DriftPolicyCorrect, DriftPolicyReport, DriftPolicyIgnore:
+		default:
+			add("mirror %s: unknown driftPolicy %q", m.Name, m.Config.DriftPolicy)
+		}
+		switch m.Config.ConflictStrategy {
+		case "", ConflictStrategyLastWriterWins, ConflictStrategyPriority, ConflictStrategyManual:
+		default:
+			add("mirror %s: unknown conflictStrategy %q", m.Name, m.Config.ConflictStrategy)
+		}
+
+		if m.Config.Workers < 0 || m.Config.MaxRetries < 0 {
+			add("mirror %s: workers and maxRetries must not be negative", m.Name)
+		}
+		if b := m.Config.Backoff; b.Base.Duration < 0 || b.Max.Duration < 0 || (b.Max.Duration > 0 && b.Base.Duration > b.Max.Duration) {
+			add("mirror %s: invalid backoff %v-%v", m.Name, b.Base.Duration, b.Max.Duration)
+		}
+
+		if len(m.Resources) == 0 {
+			add("mirror %s: at least one resource is required", m.Name)
+		}
+		for _, r := range m.Resources {
+			if len(r.Version) == 0 || len(r.Kind) == 0 {
+				add("mirror %s: resource %s/%s/%s requires version and kind", m.Name, r.Group, r.Version, r.Kind)
+			}
+			if strings.ToLower(r.Kind) != r.Kind {
+				add("mirror %s: resource kind %s should be the lowercase plural name", m.Name, r.Kind)
+			}
+		}
+		if _, err := metav1.LabelSelectorAsSelector(m.Selector); err != nil {
+			add("mirror %s: invalid selector: %v", m.Name, err)
+		}
+		for _, f := range m.Filter {
+			switch f.Action {
+			case "replace", "delete", "set":
+			default:
+				add("mirror %s: unknown filter action %q", m.Name, f.Action)
+			}
+			if len(f.Key) == 0 {
+				add("mirror %s: filter %s requires key", m.Name, f.Action)
+			}
+		}
+		for _, rule := range m.IgnoreDifferences {
+			if len(rule.Paths) == 0 {
+				add("mirror %s: ignoreDifferences requires paths", m.Name)
+			}
+		}
+	}
+
+	if c.LoopDetection == LoopDetectionRefuse {
+		for _, cycle := range c.Cycles() {
+			add("mirrors form a cycle %s", cycle)
+		}
+	}
+	return errs
+}
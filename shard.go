@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"soul-mirror/controller"
+	"soul-mirror/model"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const shardGroupLabel = "soul-mirror/shard-group"
+
+// member 分片成员的 Lease 最近一次被观察到续约的本地时间，避免依赖各副本的时钟
+type member struct {
+	renewTime metav1.MicroTime
+	observed  time.Time
+}
+
+type shard struct {
+	client  kubernetes.Interface
+	config  model.Sharding
+	id      string
+	name    string
+	members map[string]member
+	current []string
+	// 最近一次成功续约的本地时间
+	lastRenew time.Time
+}
+
+// shardMirrors 每个副本持有自己的 Lease，根据存活的成员构建一致性哈希环，只运行分配给自己的mirror
+func shardMirrors(ctx context.Context, appCfg *model.Config, run func(ctx context.Context)) error {
+	config := shardingDefaults(appCfg.Sharding)
+	client, err := leaseClient(appCfg, config.Cluster)
+	if err != nil {
+		return err
+	}
+	id := identity()
+	s := &shard{
+		client:  client,
+		config:  config,
+		id:      id,
+		name:    config.Group + "-" + id[len(id)-36:],
+		members: make(map[string]member),
+	}
+
+	// 确定成员后再启动mirror，避免启动后立即迁移
+	if err := s.renew(ctx); err != nil {
+		return err
+	}
+	if err := s.refresh(ctx); err != nil {
+		return err
+	}
+	defer s.release()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+
+	ticker := time.NewTicker(config.RenewPeriod.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			<-done
+			return nil
+		case <-ticker.C:
+			if err := s.renew(ctx); err != nil {
+				logrus.WithError(err).Warnf("unable to renew shard lease %s/%s", config.Namespace, s.name)
+			}
+			// 超过租约时长没有续约成功，其他副本会认为当前副本已退出并接管它的mirror，停止所有mirror避免重复同步
+			if time.Since(s.lastRenew) > config.LeaseDuration.Duration {
+				s.fence()
+				continue
+			}
+			if err := s.refresh(ctx); err != nil {
+				logrus.WithError(err).Warnf("unable to list shard members of %s", config.Group)
+			}
+		}
+	}
+}
+
+// renew 创建或续约当前副本的 Lease
+func (s *shard) renew(ctx context.Context) error {
+	leases := s.client.CoordinationV1().Leases(s.config.Namespace)
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(s.config.LeaseDuration.Seconds())
+	lease, err := leases.Get(ctx, s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.name,
+				Namespace: s.config.Namespace,
+				Labels:    map[string]string{shardGroupLabel: s.config.Group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.id,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+	} else if err == nil {
+		lease.Spec.RenewTime = &now
+		_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	s.lastRenew = now.Time
+	return nil
+}
+
+// fence 停止当前副本的所有mirror，续约恢复后在 refresh 中重新分配
+func (s *shard) fence() {
+	if s.current == nil {
+		return
+	}
+	s.current = nil
+	filter.SetOwner(func(string) bool { return false })
+	_, stopped := filter.Rebalance()
+	logrus.Warnf("shard lease %s/%s expired, stopped %d mirrors", s.config.Namespace, s.name, stopped)
+}
+
+// refresh 列出同组的 Lease，成员变化时重新分配mirror
+func (s *shard) refresh(ctx context.Context) error {
+	list, err := s.client.CoordinationV1().Leases(s.config.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{shardGroupLabel: s.config.Group}.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	var alive []string
+	for _, lease := range list.Items {
+		if lease.Spec.HolderIdentity == nil || lease.Spec.RenewTime == nil {
+			continue
+		}
+		holder := *lease.Spec.HolderIdentity
+		seen[holder] = true
+		last, ok := s.members[holder]
+		if !ok || !last.renewTime.Equal(lease.Spec.RenewTime) {
+			last = member{renewTime: *lease.Spec.RenewTime, observed: now}
+			s.members[holder] = last
+		}
+		if holder == s.id || now.Sub(last.observed) <= s.config.LeaseDuration.Duration {
+			alive = append(alive, holder)
+			continue
+		}
+		// 副本被强制终止时不会删除自己的 Lease，过期后由其他副本删除。带上资源版本，避免删除刚刚续约的 Lease
+		err := s.client.CoordinationV1().Leases(s.config.Namespace).Delete(ctx, lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+		})
+		if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			logrus.WithError(err).Warnf("unable to delete expired shard lease %s/%s", s.config.Namespace, lease.Name)
+		}
+	}
+	for holder := range s.members {
+		if !seen[holder] {
+			delete(s.members, holder)
+		}
+	}
+	if !seen[s.id] {
+		alive = append(alive, s.id)
+	}
+	sort.Strings(alive)
+	if reflect.DeepEqual(alive, s.current) {
+		return nil
+	}
+
+	s.current = alive
+	ring := filter.NewRing(alive)
+	filter.SetOwner(func(unit string) bool {
+		return ring.Owner(unit) == s.id
+	})
+	started, stopped := filter.Rebalance()
+	logrus.Infof("shard members of %s changed to %v, started %d mirrors, stopped %d mirrors", s.config.Group, alive, started, stopped)
+	return nil
+}
+
+// release 删除当前副本的 Lease，其他副本在下一次续约时接管
+func (s *shard) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.client.CoordinationV1().Leases(s.config.Namespace).Delete(ctx, s.name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		logrus.WithError(err).Warnf("unable to delete shard lease %s/%s", s.config.Namespace, s.name)
+	}
+}
+
+func shardingDefaults(s model.Sharding) model.Sharding {
+	if len(s.Group) == 0 {
+		s.Group = "soul-mirror"
+	}
+	if len(s.Namespace) == 0 {
+		s.Namespace = currentNamespace()
+	}
+	if s.LeaseDuration.Duration == 0 {
+		s.LeaseDuration.Duration = 15 * time.Second
+	}
+	if s.RenewPeriod.Duration == 0 {
+		s.RenewPeriod.Duration = 5 * time.Second
+	}
+	return s
+}